@@ -2,7 +2,10 @@ package cel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +20,8 @@ type Context struct {
 	Functions map[string]Function
 	timeNow   func() time.Time
 	pool      *StringPool
+	parent    *Context
+	bindings  map[string]*lazyBinding
 }
 
 // Context implements context.Context interface
@@ -41,12 +46,30 @@ type Function interface {
 	Call(ctx context.Context, args ...Value) (Value, error)
 }
 
+// LambdaFunc is the runtime value of a lambda expression such as x => x * 2.
+// It is an alias so that Function implementations can type-assert lambda
+// arguments without importing a named type.
+type LambdaFunc = func(ctx context.Context, args ...Value) (Value, error)
+
+// Invoke calls fn with args. fn may be a lambda value or a Function, which
+// lets Function implementations call predicates passed to them as arguments.
+func Invoke(ctx context.Context, fn Value, args ...Value) (Value, error) {
+	switch f := fn.(type) {
+	case LambdaFunc:
+		return f(ctx, args...)
+	case Function:
+		return f.Call(ctx, args...)
+	}
+	return nil, fmt.Errorf("value of type %T is not callable", fn)
+}
+
 // MethodHandler represents a method callable on a value
 type MethodHandler func(ctx context.Context, receiver Value, args ...Value) (Value, error)
 
 // Expression represents a parsed and compiled expression
 type Expression struct {
 	ast       ASTNode
+	source    string
 	optimized bool
 }
 
@@ -55,22 +78,61 @@ func (e *Expression) Evaluate(ctx *Context) (Value, error) {
 	if e.ast == nil {
 		return nil, fmt.Errorf("expression not parsed")
 	}
-	return e.ast.Evaluate(ctx)
+	val, err := evaluate(ctx, e.ast)
+	if err != nil {
+		var evalErr *EvalError
+		if errors.As(err, &evalErr) && evalErr.Source == "" && evalErr.Span.End <= len(e.source) {
+			evalErr.Source = e.source[evalErr.Span.Start:evalErr.Span.End]
+		}
+		return nil, err
+	}
+	return val, nil
+}
+
+// AST returns the root node of the parsed expression
+func (e *Expression) AST() ASTNode {
+	return e.ast
 }
 
-// Parse parses the expression and returns an expression object
+// Parse parses the expression and returns an expression object. Parsing
+// continues past syntax errors so that all of them are reported at once as
+// a ParseErrors list; the returned expression is then a partial AST in
+// which the unparseable parts are BadExpr nodes.
 func (p *Parser) Parse() (*Expression, error) {
-	tokens, err := p.tokenize()
-	if err != nil {
-		return nil, err
+	ast := p.parse()
+	if len(p.errors) > 0 {
+		for _, err := range p.errors {
+			err.locate(p.expr)
+		}
+		sort.SliceStable(p.errors, func(i, j int) bool {
+			return p.errors[i].Offset < p.errors[j].Offset
+		})
+		return &Expression{ast: ast, source: p.expr}, p.errors
 	}
-	p.tokens = tokens
+
+	return &Expression{ast: ast, source: p.expr}, nil
+}
+
+func (p *Parser) parse() ASTNode {
+	return p.parseFrom(0)
+}
+
+// parseFrom parses the expression starting at offset start
+func (p *Parser) parseFrom(start int) ASTNode {
+	p.errors = nil
+	p.tokens = p.scan(start, false)
+	p.pos = 0
+
 	ast, err := p.parseExpression(0)
 	if err != nil {
-		return nil, err
+		p.pos = len(p.tokens) - 1
+		return p.badExpr(err, 0)
 	}
 
-	return &Expression{ast: ast}, nil
+	if token := p.peekToken(); token.Type != TokenEOF {
+		p.addError(newParseError(token.Pos, "unexpected %s after end of expression", p.describe(token)))
+	}
+	return ast
 }
 
 // Parser parses CEL expressions
@@ -79,6 +141,11 @@ type Parser struct {
 	tokens    []Token
 	pos       int
 	functions map[string]Function
+	errors    ParseErrors
+
+	// inGuard is set while parsing a match guard, where => ends the guard
+	// rather than starting a lambda
+	inGuard bool
 }
 
 // NewParser creates a new parser for the given expression
@@ -95,11 +162,33 @@ type ASTNode interface {
 	String() string
 }
 
-// Token represents a lexical token
+// Span is the byte range [Start, End) of a node in the source expression
+type Span struct {
+	Start int
+	End   int
+}
+
+// Spanned is implemented by AST nodes that record where they appear in the
+// source expression. Every node produced by the parser implements it.
+type Spanned interface {
+	Span() Span
+}
+
+// nodeSpan is embedded in AST nodes to implement Spanned
+type nodeSpan struct {
+	span Span
+}
+
+func (n *nodeSpan) Span() Span        { return n.span }
+func (n *nodeSpan) setSpan(span Span) { n.span = span }
+
+// Token represents a lexical token. Pos and End are the byte offsets of the
+// token's first character and of the character just past it.
 type Token struct {
 	Type  TokenType
 	Value string
 	Pos   int
+	End   int
 }
 
 // TokenType represents the type of token
@@ -113,148 +202,464 @@ const (
 	TokenOperator
 	TokenKeyword
 	TokenPunctuation
+	TokenBytes
+	TokenComment
+	TokenWhitespace
+	TokenQuotedIdentifier
+	TokenTemplate
 )
 
 // AST Node Types
 type (
 	// Literal nodes
 	NumberLiteral struct {
+		nodeSpan
 		Value float64
 		raw   string
 	}
 
+	IntLiteral struct {
+		nodeSpan
+		Value int64
+		raw   string
+	}
+
+	UintLiteral struct {
+		nodeSpan
+		Value uint64
+		raw   string
+	}
+
 	StringLiteral struct {
+		nodeSpan
 		Value string
 		raw   string
 	}
 
+	BytesLiteral struct {
+		nodeSpan
+		Value []byte
+		raw   string
+	}
+
+	// Template is an interpolated string literal such as f"Hello {name}".
+	// Text holds the literal text around the placeholder expressions, so it
+	// has one more element than Exprs.
+	Template struct {
+		nodeSpan
+		Text  []string
+		Exprs []ASTNode
+	}
+
 	BooleanLiteral struct {
+		nodeSpan
 		Value bool
 		raw   string
 	}
 
 	NullLiteral struct {
+		nodeSpan
 		Value Value
 	}
 
 	ArrayLiteral struct {
+		nodeSpan
 		Elements []ASTNode
 	}
 
 	MapLiteral struct {
-		Pairs map[ASTNode]ASTNode
+		nodeSpan
+		Pairs []MapPair
 	}
 
 	// Variable and identifier nodes
 	Identifier struct {
+		nodeSpan
 		Name string
 	}
 
+	// Select accesses a field of a map or struct value, e.g. user.name. An
+	// Optional select, written user?.name, yields null instead of failing
+	// when the operand is null or undefined or the field is missing.
+	Select struct {
+		nodeSpan
+		Operand  ASTNode
+		Field    string
+		Optional bool
+	}
+
+	// Index accesses a list element, map entry or string character, e.g. items[0]
+	Index struct {
+		nodeSpan
+		Operand ASTNode
+		Index   ASTNode
+	}
+
+	// Slice takes a sub-range of a list or string, e.g. name[0:3]. Start and
+	// End are nil when the bound is omitted.
+	Slice struct {
+		nodeSpan
+		Operand ASTNode
+		Start   ASTNode
+		End     ASTNode
+	}
+
 	// Operation nodes
 	BinaryOp struct {
+		nodeSpan
 		Op    string
 		Left  ASTNode
 		Right ASTNode
 	}
 
 	UnaryOp struct {
+		nodeSpan
 		Op   string
 		Expr ASTNode
 	}
 
+	// Between tests whether Expr lies within [Low, High], or (Low, High)
+	// when Exclusive is set
+	Between struct {
+		nodeSpan
+		Expr      ASTNode
+		Low       ASTNode
+		High      ASTNode
+		Exclusive bool
+	}
+
 	Ternary struct {
+		nodeSpan
 		Cond ASTNode
 		Then ASTNode
 		Else ASTNode
 	}
 
+	// Spread is a ...value element of a list or map literal, which inserts
+	// all elements of a list or all entries of a map. Spreading null
+	// inserts nothing.
+	Spread struct {
+		nodeSpan
+		Value ASTNode
+	}
+
+	// Comprehension builds a list or map in a single pass over a list or
+	// map, e.g. [u.name for u in users if u.active] or
+	// {k: v * 2 for k, v in prices}. Value is nil for a list comprehension.
+	// With two variables they are bound to each index and element of a list
+	// or key and value of a map; a single variable is bound to the element
+	// of a list or the key of a map. Maps are iterated in key order.
+	Comprehension struct {
+		nodeSpan
+		Key       ASTNode
+		Value     ASTNode
+		Variables []string
+		Source    ASTNode
+		Cond      ASTNode
+	}
+
+	// Match evaluates the body of the first arm whose pattern matches the
+	// subject and whose guard, if any, holds, e.g.
+	// match tier { "gold" => 0.2, "silver" => 0.1, _ => 0.0 }. The parser
+	// requires the last arm to be a catch-all.
+	Match struct {
+		nodeSpan
+		Subject ASTNode
+		Arms    []MatchArm
+	}
+
+	// Let binds Name to Value while evaluating Body, e.g.
+	// let total = sum(items); total > 100. Value is evaluated at most once,
+	// on first use.
+	Let struct {
+		nodeSpan
+		Name  string
+		Value ASTNode
+		Body  ASTNode
+	}
+
+	// Lambda is an anonymous function such as (x, y) => x + y. It evaluates
+	// to a LambdaFunc closing over the context it was evaluated in.
+	Lambda struct {
+		nodeSpan
+		Params []string
+		Body   ASTNode
+	}
+
 	// Function and method call nodes
 	FunctionCall struct {
+		nodeSpan
 		Name      string
 		Arguments []ASTNode
 	}
 
+	// Pipe passes a value to a function call as its first argument, e.g.
+	// numbers |> avg(). For the collection macros the value is the source,
+	// so numbers |> filter(n, n > 5) is filter(n, numbers, n > 5).
+	Pipe struct {
+		nodeSpan
+		Value ASTNode
+		Call  *FunctionCall
+	}
+
+	// MethodCall calls a method on a value, e.g. name.upper(). An Optional
+	// call, written name?.upper(), yields null when the receiver is null or
+	// undefined.
 	MethodCall struct {
+		nodeSpan
 		Object    ASTNode
 		Method    string
 		Arguments []ASTNode
+		Optional  bool
 	}
 
 	// Collection operations
 	Filter struct {
+		nodeSpan
 		Variable  string
 		Source    ASTNode
 		Predicate ASTNode
 	}
 
 	Map struct {
+		nodeSpan
 		Variable  string
 		Source    ASTNode
 		Transform ASTNode
 	}
 
 	All struct {
+		nodeSpan
 		Variable  string
 		Source    ASTNode
 		Predicate ASTNode
 	}
 
 	Exists struct {
+		nodeSpan
+		Variable  string
+		Source    ASTNode
+		Predicate ASTNode
+	}
+
+	ExistsOne struct {
+		nodeSpan
 		Variable  string
 		Source    ASTNode
 		Predicate ASTNode
 	}
 
 	Find struct {
+		nodeSpan
 		Variable  string
 		Source    ASTNode
 		Predicate ASTNode
 	}
 
 	Size struct {
+		nodeSpan
 		Expr ASTNode
 	}
 
 	First struct {
+		nodeSpan
 		Expr ASTNode
 	}
 
 	Last struct {
+		nodeSpan
 		Expr ASTNode
 	}
+
+	// BadExpr stands in for a part of the expression that could not be
+	// parsed. From and To are the byte offsets of the skipped source.
+	BadExpr struct {
+		nodeSpan
+		From int
+		To   int
+	}
 )
 
-// String methods for AST nodes
-func (n *NumberLiteral) String() string  { return n.raw }
-func (n *StringLiteral) String() string  { return n.raw }
-func (n *BooleanLiteral) String() string { return n.raw }
-func (n *NullLiteral) String() string    { return "null" }
-func (n *ArrayLiteral) String() string   { return "[]" }
-func (n *MapLiteral) String() string     { return "{}" }
-func (n *Identifier) String() string     { return n.Name }
-func (n *BinaryOp) String() string       { return fmt.Sprintf("(%s %s %s)", n.Left, n.Op, n.Right) }
-func (n *UnaryOp) String() string        { return fmt.Sprintf("(%s %s)", n.Op, n.Expr) }
-func (n *Ternary) String() string        { return fmt.Sprintf("(%s ? %s : %s)", n.Cond, n.Then, n.Else) }
-func (n *FunctionCall) String() string   { return fmt.Sprintf("%s(...)", n.Name) }
-func (n *MethodCall) String() string     { return fmt.Sprintf("%s.%s(...)", n.Object, n.Method) }
-func (n *Filter) String() string         { return "filter(...)" }
-func (n *Map) String() string            { return "map(...)" }
-func (n *All) String() string            { return "all(...)" }
-func (n *Exists) String() string         { return "exists(...)" }
-func (n *Find) String() string           { return "find(...)" }
-func (n *Size) String() string           { return "size(...)" }
-func (n *First) String() string          { return "first(...)" }
-func (n *Last) String() string           { return "last(...)" }
+// MapPair is a single key/value entry of a MapLiteral, kept in source order.
+// A spread entry ...m has a *Spread Key and a nil Value.
+type MapPair struct {
+	Key   ASTNode
+	Value ASTNode
+}
+
+// MatchArm is one pattern [if guard] => body arm of a match expression.
+// Guard is nil if the arm has none.
+type MatchArm struct {
+	Pattern Pattern
+	Guard   ASTNode
+	Body    ASTNode
+}
+
+// Pattern is the pattern of a match arm. The variables a pattern binds are
+// in scope in the arm's guard and body.
+type Pattern interface {
+	Spanned
+	String() string
+	matchValue(val Value, bindings map[string]Value) bool
+}
+
+type (
+	// WildcardPattern, written _, matches any value
+	WildcardPattern struct {
+		nodeSpan
+	}
+
+	// BindPattern matches any value and binds it to Name
+	BindPattern struct {
+		nodeSpan
+		Name string
+	}
+
+	// LiteralPattern matches values equal to a literal. Numbers match
+	// numbers of any type; other values only match values of the same kind,
+	// so "1" does not match 1.
+	LiteralPattern struct {
+		nodeSpan
+		Literal ASTNode
+	}
+
+	// ListPattern matches lists of the same length whose elements match
+	// the element patterns, e.g. [first, _]
+	ListPattern struct {
+		nodeSpan
+		Elements []Pattern
+	}
+
+	// MapPattern matches maps and structs that have all of the given keys
+	// with matching values, e.g. {"kind": "vip", "rate": r}. Other keys are
+	// ignored.
+	MapPattern struct {
+		nodeSpan
+		Entries []MapPatternEntry
+	}
+)
+
+// MapPatternEntry is one key: pattern entry of a MapPattern. Key is a
+// literal.
+type MapPatternEntry struct {
+	Key     ASTNode
+	Pattern Pattern
+}
+
+// String methods for AST nodes return their source form, see Unparse
+func (n *NumberLiteral) String() string  { return Unparse(n) }
+func (n *IntLiteral) String() string     { return Unparse(n) }
+func (n *UintLiteral) String() string    { return Unparse(n) }
+func (n *StringLiteral) String() string  { return Unparse(n) }
+func (n *BytesLiteral) String() string   { return Unparse(n) }
+func (n *BooleanLiteral) String() string { return Unparse(n) }
+func (n *NullLiteral) String() string    { return Unparse(n) }
+func (n *ArrayLiteral) String() string   { return Unparse(n) }
+func (n *MapLiteral) String() string     { return Unparse(n) }
+func (n *Identifier) String() string     { return Unparse(n) }
+func (n *Select) String() string         { return Unparse(n) }
+func (n *Index) String() string          { return Unparse(n) }
+func (n *BinaryOp) String() string       { return Unparse(n) }
+func (n *UnaryOp) String() string        { return Unparse(n) }
+func (n *Ternary) String() string        { return Unparse(n) }
+func (n *FunctionCall) String() string   { return Unparse(n) }
+func (n *MethodCall) String() string     { return Unparse(n) }
+func (n *Filter) String() string         { return Unparse(n) }
+func (n *Map) String() string            { return Unparse(n) }
+func (n *All) String() string            { return Unparse(n) }
+func (n *Exists) String() string         { return Unparse(n) }
+func (n *ExistsOne) String() string      { return Unparse(n) }
+func (n *Find) String() string           { return Unparse(n) }
+func (n *Size) String() string           { return Unparse(n) }
+func (n *First) String() string          { return Unparse(n) }
+func (n *Last) String() string           { return Unparse(n) }
+func (n *BadExpr) String() string        { return Unparse(n) }
+func (n *Slice) String() string          { return Unparse(n) }
+func (n *Let) String() string            { return Unparse(n) }
+func (n *Lambda) String() string         { return Unparse(n) }
+func (n *Between) String() string        { return Unparse(n) }
+func (n *Template) String() string       { return Unparse(n) }
+func (n *Pipe) String() string           { return Unparse(n) }
+func (n *Match) String() string          { return Unparse(n) }
+func (n *Comprehension) String() string  { return Unparse(n) }
+func (n *Spread) String() string         { return Unparse(n) }
+
+func (n *WildcardPattern) String() string { return unparsePattern(n) }
+func (n *BindPattern) String() string     { return unparsePattern(n) }
+func (n *LiteralPattern) String() string  { return unparsePattern(n) }
+func (n *ListPattern) String() string     { return unparsePattern(n) }
+func (n *MapPattern) String() string      { return unparsePattern(n) }
+
+// evaluate evaluates a node. Errors that have not yet been attributed to a
+// node are wrapped in an EvalError carrying the node's span, so that the
+// innermost failing node is reported.
+func evaluate(ctx *Context, node ASTNode) (Value, error) {
+	val, err := node.Evaluate(ctx)
+	if err != nil {
+		var evalErr *EvalError
+		if errors.As(err, &evalErr) {
+			return nil, err
+		}
+		var span Span
+		if spanned, ok := node.(Spanned); ok {
+			span = spanned.Span()
+		}
+		return nil, &EvalError{Span: span, Err: err, node: node}
+	}
+	return val, nil
+}
 
 // Evaluate implementations for AST nodes
+func (n *BadExpr) Evaluate(ctx *Context) (Value, error) {
+	return nil, fmt.Errorf("invalid expression at position %d", n.From)
+}
+
 func (n *NumberLiteral) Evaluate(ctx *Context) (Value, error) {
 	return n.Value, nil
 }
 
+func (n *IntLiteral) Evaluate(ctx *Context) (Value, error) {
+	return n.Value, nil
+}
+
+func (n *UintLiteral) Evaluate(ctx *Context) (Value, error) {
+	return n.Value, nil
+}
+
 func (n *StringLiteral) Evaluate(ctx *Context) (Value, error) {
 	return n.Value, nil
 }
 
+// Evaluate renders the placeholders as string() would and concatenates
+// them with the literal text
+func (n *Template) Evaluate(ctx *Context) (Value, error) {
+	// A Context built as a struct literal has no pool
+	b := &strings.Builder{}
+	if ctx.pool != nil {
+		b = ctx.pool.Get()
+		defer ctx.pool.Put(b)
+	}
+
+	for i, expr := range n.Exprs {
+		b.WriteString(n.Text[i])
+		val, err := evaluate(ctx, expr)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := val.(string); ok {
+			b.WriteString(s)
+		} else {
+			fmt.Fprintf(b, "%v", val)
+		}
+	}
+	b.WriteString(n.Text[len(n.Exprs)])
+	return b.String(), nil
+}
+
+func (n *BytesLiteral) Evaluate(ctx *Context) (Value, error) {
+	return n.Value, nil
+}
+
 func (n *BooleanLiteral) Evaluate(ctx *Context) (Value, error) {
 	return n.Value, nil
 }
@@ -266,39 +671,124 @@ func (n *NullLiteral) Evaluate(ctx *Context) (Value, error) {
 func (n *ArrayLiteral) Evaluate(ctx *Context) (Value, error) {
 	values := make([]Value, 0, len(n.Elements))
 	for _, elem := range n.Elements {
-		val, err := elem.Evaluate(ctx)
+		val, err := evaluate(ctx, elem)
+		if err != nil {
+			return nil, err
+		}
+		if !isSpread(elem) {
+			values = append(values, val)
+			continue
+		}
+
+		if isNull(val) {
+			continue
+		}
+		if kind := reflect.ValueOf(val).Kind(); kind != reflect.Slice && kind != reflect.Array {
+			return nil, fmt.Errorf("cannot spread %T into a list", val)
+		}
+		err = forEachEntry(val, func(_, item Value) error {
+			values = append(values, item)
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		values = append(values, val)
 	}
 	return values, nil
 }
 
+// Evaluate returns the value being spread; the enclosing literal inserts
+// its elements or entries
+func (n *Spread) Evaluate(ctx *Context) (Value, error) {
+	return evaluate(ctx, n.Value)
+}
+
+// Evaluate builds the map from left to right, so that an entry replaces
+// any earlier one with the same key, as in {...defaults, ...overrides}.
+// This includes explicit entries: in {"a": 9, ...m} a key a of m wins, and
+// in {...m, "a": 9} the explicit entry does. Two explicit entries with the
+// same key are an error.
 func (n *MapLiteral) Evaluate(ctx *Context) (Value, error) {
-	result := make(map[string]Value, len(n.Pairs))
-	for keyNode, valNode := range n.Pairs {
-		key, err := keyNode.Evaluate(ctx)
+	keys := make([]Value, 0, len(n.Pairs))
+	values := make([]Value, 0, len(n.Pairs))
+	explicit := make(map[Value]bool, len(n.Pairs))
+	stringKeys := true
+	add := func(key, val Value) {
+		if _, ok := key.(string); !ok {
+			stringKeys = false
+		}
+		keys = append(keys, key)
+		values = append(values, val)
+	}
+
+	for _, pair := range n.Pairs {
+		if isSpread(pair.Key) {
+			src, err := evaluate(ctx, pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			if isNull(src) {
+				continue
+			}
+			if reflect.ValueOf(src).Kind() != reflect.Map {
+				return nil, fmt.Errorf("cannot spread %T into a map", src)
+			}
+			err = forEachEntry(src, func(key, val Value) error {
+				key, err := normalizeMapKey(key)
+				if err != nil {
+					return err
+				}
+				add(key, val)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		key, err := evaluate(ctx, pair.Key)
 		if err != nil {
 			return nil, err
 		}
-		keyStr, ok := key.(string)
-		if !ok {
-			return nil, fmt.Errorf("map key must be string, got %T", key)
+		if key, err = normalizeMapKey(key); err != nil {
+			return nil, err
 		}
+		if explicit[key] {
+			if s, ok := key.(string); ok {
+				return nil, fmt.Errorf("duplicate map key: %q", s)
+			}
+			return nil, fmt.Errorf("duplicate map key: %v", key)
+		}
+		explicit[key] = true
 
-		val, err := valNode.Evaluate(ctx)
+		val, err := evaluate(ctx, pair.Value)
 		if err != nil {
 			return nil, err
 		}
-		result[keyStr] = val
+		add(key, val)
+	}
+
+	// Maps keyed only by strings use the common map[string]Value
+	// representation; any other key type produces a map[Value]Value.
+	if stringKeys {
+		result := make(map[string]Value, len(keys))
+		for i, key := range keys {
+			result[key.(string)] = values[i]
+		}
+		return result, nil
+	}
+
+	result := make(map[Value]Value, len(keys))
+	for i, key := range keys {
+		result[key] = values[i]
 	}
 	return result, nil
 }
 
 func (n *Identifier) Evaluate(ctx *Context) (Value, error) {
-	if val, ok := ctx.Variables[n.Name]; ok {
-		return val, nil
+	if val, ok, err := ctx.lookup(n.Name); ok {
+		return val, err
 	}
 
 	// Check for built-in functions
@@ -306,482 +796,701 @@ func (n *Identifier) Evaluate(ctx *Context) (Value, error) {
 		return fn, nil
 	}
 
-	return nil, fmt.Errorf("undefined variable: %s", n.Name)
+	return nil, &UndefinedVariableError{Name: n.Name}
 }
 
-func (n *BinaryOp) Evaluate(ctx *Context) (Value, error) {
-	left, err := n.Left.Evaluate(ctx)
+func (n *Select) Evaluate(ctx *Context) (Value, error) {
+	operand, err := evaluateReceiver(ctx, n.Operand, n.Optional)
+	if err != nil || (n.Optional && isNull(operand)) {
+		return nil, err
+	}
+
+	val, err := selectField(operand, n.Field, n)
+	if n.Optional {
+		var noSuchKey *NoSuchKeyError
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+	}
+	return val, err
+}
+
+// evaluateReceiver evaluates the operand of a select or method call. For
+// the optional forms an undefined root variable evaluates to null, so that
+// a?.b works when a is absent altogether.
+func evaluateReceiver(ctx *Context, node ASTNode, optional bool) (Value, error) {
+	val, err := evaluate(ctx, node)
+	if err != nil && optional {
+		var undefined *UndefinedVariableError
+		if _, ok := node.(*Identifier); ok && errors.As(err, &undefined) {
+			return nil, nil
+		}
+	}
+	return val, err
+}
+
+func (n *Index) Evaluate(ctx *Context) (Value, error) {
+	operand, err := evaluate(ctx, n.Operand)
 	if err != nil {
 		return nil, err
 	}
 
-	right, err := n.Right.Evaluate(ctx)
+	index, err := evaluate(ctx, n.Index)
 	if err != nil {
 		return nil, err
 	}
 
-	return evaluateBinaryOp(n.Op, left, right, ctx)
+	return indexValue(operand, index, n)
 }
 
-func (n *UnaryOp) Evaluate(ctx *Context) (Value, error) {
-	expr, err := n.Expr.Evaluate(ctx)
+func (n *Slice) Evaluate(ctx *Context) (Value, error) {
+	operand, err := evaluate(ctx, n.Operand)
 	if err != nil {
 		return nil, err
 	}
 
-	return evaluateUnaryOp(n.Op, expr, ctx)
+	var start, end Value
+	if n.Start != nil {
+		if start, err = evaluate(ctx, n.Start); err != nil {
+			return nil, err
+		}
+	}
+	if n.End != nil {
+		if end, err = evaluate(ctx, n.End); err != nil {
+			return nil, err
+		}
+	}
+
+	return sliceValue(operand, start, end)
 }
 
-func (n *Ternary) Evaluate(ctx *Context) (Value, error) {
-	cond, err := n.Cond.Evaluate(ctx)
+func (n *BinaryOp) Evaluate(ctx *Context) (Value, error) {
+	if n.Op == "??" {
+		return n.coalesce(ctx)
+	}
+
+	left, err := evaluate(ctx, n.Left)
 	if err != nil {
 		return nil, err
 	}
 
-	condBool, ok := cond.(bool)
-	if !ok {
-		return nil, fmt.Errorf("ternary condition must be boolean, got %T", cond)
+	right, err := evaluate(ctx, n.Right)
+	if err != nil {
+		return nil, err
 	}
 
-	if condBool {
-		return n.Then.Evaluate(ctx)
-	}
-	return n.Else.Evaluate(ctx)
+	return evaluateBinaryOp(n.Op, left, right, ctx)
 }
 
-func (n *FunctionCall) Evaluate(ctx *Context) (Value, error) {
-	// Check for collection operations that need specialized handling
-	if n.Name == "filter" || n.Name == "map" || n.Name == "all" || n.Name == "exists" || n.Name == "find" {
-		return n.evaluateCollectionOperation(ctx)
-	}
-
-	// First try built-in functions
-	if fn, ok := builtinFunctions[n.Name]; ok {
-		if fn == nil {
-			return nil, fmt.Errorf("builtin function %s is nil", n.Name)
-		}
-		args, err := evaluateArgs(n.Arguments, ctx)
-		if err != nil {
+// coalesce evaluates left ?? right: the right operand is only evaluated
+// when the left one is null or missing. The left operand only counts as
+// missing when its own access path fails, so in f(typo) ?? 0 the undefined
+// argument is still reported.
+func (n *BinaryOp) coalesce(ctx *Context) (Value, error) {
+	left, err := evaluate(ctx, n.Left)
+	if err != nil {
+		var evalErr *EvalError
+		if !errors.As(err, &evalErr) || !isMissing(evalErr.Err) || !onAccessPath(n.Left, evalErr.node) {
 			return nil, err
 		}
-		return fn(ctx, args...)
+	} else if !isNull(left) {
+		return left, nil
 	}
+	return evaluate(ctx, n.Right)
+}
 
-	// Then try custom functions
-	if fn, ok := ctx.Functions[n.Name]; ok {
-		if fn == nil {
-			return nil, fmt.Errorf("function %s is nil", n.Name)
+// onAccessPath reports whether target is node or one of the identifiers,
+// selects and indexes it is accessed through, such as a, a.b or a.b[0] in
+// a.b[0].c. The index expressions themselves are not on the path, and
+// neither is anything inside a function call. The fallback of a nested ??
+// is, so that a ?? b ?? c moves on to c when b is missing too.
+func onAccessPath(node, target ASTNode) bool {
+	for node != nil {
+		if node == target {
+			return true
 		}
-		args, err := evaluateArgs(n.Arguments, ctx)
-		if err != nil {
-			return nil, err
+		switch n := node.(type) {
+		case *Select:
+			node = n.Operand
+		case *Index:
+			node = n.Operand
+		case *BinaryOp:
+			if n.Op != "??" {
+				return false
+			}
+			node = n.Right
+		default:
+			return false
 		}
-		return fn.Call(ctx, args...)
+	}
+	return false
+}
+
+func (n *UnaryOp) Evaluate(ctx *Context) (Value, error) {
+	expr, err := evaluate(ctx, n.Expr)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("undefined function: %s", n.Name)
+	return evaluateUnaryOp(n.Op, expr, ctx)
 }
 
-// evaluateCollectionOperation handles collection operations with variable scoping
-func (n *FunctionCall) evaluateCollectionOperation(ctx *Context) (Value, error) {
-	if len(n.Arguments) != 3 {
-		return nil, fmt.Errorf("%s() requires 3 arguments", n.Name)
+func (n *Between) Evaluate(ctx *Context) (Value, error) {
+	expr, err := evaluate(ctx, n.Expr)
+	if err != nil {
+		return nil, err
 	}
 
-	// Parse variable name
-	variableNode, ok := n.Arguments[0].(*Identifier)
-	if !ok {
-		return nil, fmt.Errorf("%s() first argument must be variable name", n.Name)
+	low, err := evaluate(ctx, n.Low)
+	if err != nil {
+		return nil, err
 	}
 
-	source, err := n.Arguments[1].Evaluate(ctx)
+	high, err := evaluate(ctx, n.High)
 	if err != nil {
 		return nil, err
 	}
 
-	slice, ok := source.([]Value)
+	return evaluateBetween(expr, low, high, n.Exclusive)
+}
+
+func (n *Ternary) Evaluate(ctx *Context) (Value, error) {
+	cond, err := evaluate(ctx, n.Cond)
+	if err != nil {
+		return nil, err
+	}
+
+	condBool, ok := cond.(bool)
 	if !ok {
-		return nil, fmt.Errorf("%s() second argument must be array, got %T", n.Name, source)
+		return nil, fmt.Errorf("ternary condition must be boolean, got %T", cond)
 	}
 
-	predicate := n.Arguments[2]
+	if condBool {
+		return evaluate(ctx, n.Then)
+	}
+	return evaluate(ctx, n.Else)
+}
 
-	switch n.Name {
-	case "filter":
-		result := make([]Value, 0, len(slice))
-		for _, item := range slice {
-			// Save current variables
-			oldVal := ctx.Variables[variableNode.Name]
-			ctx.Variables[variableNode.Name] = item
+func (n *Comprehension) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
+	if err != nil {
+		return nil, err
+	}
+	kind := reflect.ValueOf(source).Kind()
+	isList := kind == reflect.Slice || kind == reflect.Array
+
+	list := make([]Value, 0)
+	var keys, values []Value
+	err = forEachEntry(source, func(key, val Value) error {
+		// A new scope per element, so lambdas built in the body capture
+		// their own element
+		scope := ctx.newScope(len(n.Variables))
+		switch {
+		case len(n.Variables) == 2:
+			scope.Variables[n.Variables[0]] = key
+			scope.Variables[n.Variables[1]] = val
+		case isList:
+			scope.Variables[n.Variables[0]] = val
+		default:
+			scope.Variables[n.Variables[0]] = key
+		}
 
-			keep, err := predicate.Evaluate(ctx)
+		if n.Cond != nil {
+			cond, err := evaluate(scope, n.Cond)
 			if err != nil {
-				return nil, err
+				return err
 			}
-
-			if keep.(bool) {
-				result = append(result, item)
+			ok, isBool := cond.(bool)
+			if !isBool {
+				return fmt.Errorf("comprehension condition must be boolean, got %T", cond)
 			}
-
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[variableNode.Name] = oldVal
-			} else {
-				delete(ctx.Variables, variableNode.Name)
+			if !ok {
+				return nil
 			}
 		}
-		return result, nil
-
-	case "map":
-		result := make([]Value, 0, len(slice))
-		for _, item := range slice {
-			// Save current variables
-			oldVal := ctx.Variables[variableNode.Name]
-			ctx.Variables[variableNode.Name] = item
-
-			transformed, err := predicate.Evaluate(ctx)
-			if err != nil {
-				return nil, err
-			}
 
-			result = append(result, transformed)
+		result, err := evaluate(scope, n.Key)
+		if err != nil {
+			return err
+		}
+		if n.Value == nil {
+			list = append(list, result)
+			return nil
+		}
 
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[variableNode.Name] = oldVal
-			} else {
-				delete(ctx.Variables, variableNode.Name)
-			}
+		if result, err = normalizeMapKey(result); err != nil {
+			return err
 		}
-		return result, nil
-
-	case "all":
-		for _, item := range slice {
-			// Save current variables
-			oldVal := ctx.Variables[variableNode.Name]
-			ctx.Variables[variableNode.Name] = item
+		value, err := evaluate(scope, n.Value)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, result)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n.Value == nil {
+		return list, nil
+	}
 
-			keep, err := predicate.Evaluate(ctx)
-			if err != nil {
-				return nil, err
+	// Unlike map literals, later entries replace earlier ones with the same
+	// key
+	stringKeys := make(map[string]Value, len(keys))
+	for i, key := range keys {
+		s, ok := key.(string)
+		if !ok {
+			result := make(map[Value]Value, len(keys))
+			for i, key := range keys {
+				result[key] = values[i]
 			}
+			return result, nil
+		}
+		stringKeys[s] = values[i]
+	}
+	return stringKeys, nil
+}
 
-			if !keep.(bool) {
-				// Restore variable
-				if oldVal != nil {
-					ctx.Variables[variableNode.Name] = oldVal
-				} else {
-					delete(ctx.Variables, variableNode.Name)
-				}
-				return false, nil
-			}
+func (n *Match) Evaluate(ctx *Context) (Value, error) {
+	subject, err := evaluate(ctx, n.Subject)
+	if err != nil {
+		return nil, err
+	}
 
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[variableNode.Name] = oldVal
-			} else {
-				delete(ctx.Variables, variableNode.Name)
-			}
+	for _, arm := range n.Arms {
+		// Patterns without variables never write to the bindings, so the
+		// arm can share the enclosing scope
+		scope := ctx
+		if len(patternNames(arm.Pattern)) > 0 {
+			scope = ctx.newScope(0)
+		}
+		if !arm.Pattern.matchValue(subject, scope.Variables) {
+			continue
 		}
-		return true, nil
-
-	case "exists":
-		for _, item := range slice {
-			// Save current variables
-			oldVal := ctx.Variables[variableNode.Name]
-			ctx.Variables[variableNode.Name] = item
 
-			keep, err := predicate.Evaluate(ctx)
+		if arm.Guard != nil {
+			guard, err := evaluate(scope, arm.Guard)
 			if err != nil {
 				return nil, err
 			}
-
-			if keep.(bool) {
-				// Restore variable
-				if oldVal != nil {
-					ctx.Variables[variableNode.Name] = oldVal
-				} else {
-					delete(ctx.Variables, variableNode.Name)
-				}
-				return true, nil
+			ok, isBool := guard.(bool)
+			if !isBool {
+				return nil, fmt.Errorf("match guard must be boolean, got %T", guard)
 			}
-
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[variableNode.Name] = oldVal
-			} else {
-				delete(ctx.Variables, variableNode.Name)
+			if !ok {
+				continue
 			}
 		}
-		return false, nil
+		return evaluate(scope, arm.Body)
+	}
+	return nil, fmt.Errorf("no match arm matches %v", subject)
+}
 
-	case "find":
-		for _, item := range slice {
-			// Save current variables
-			oldVal := ctx.Variables[variableNode.Name]
-			ctx.Variables[variableNode.Name] = item
+func (n *WildcardPattern) matchValue(Value, map[string]Value) bool {
+	return true
+}
 
-			found, err := predicate.Evaluate(ctx)
-			if err != nil {
-				return nil, err
-			}
+func (n *BindPattern) matchValue(val Value, bindings map[string]Value) bool {
+	bindings[n.Name] = val
+	return true
+}
 
-			if found.(bool) {
-				// Restore variable
-				if oldVal != nil {
-					ctx.Variables[variableNode.Name] = oldVal
-				} else {
-					delete(ctx.Variables, variableNode.Name)
-				}
-				return item, nil
-			}
+func (n *LiteralPattern) matchValue(val Value, _ map[string]Value) bool {
+	literal, err := n.Literal.Evaluate(nil)
+	if err != nil {
+		return false
+	}
+	if literal == nil {
+		return isNull(val)
+	}
 
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[variableNode.Name] = oldVal
-			} else {
-				delete(ctx.Variables, variableNode.Name)
-			}
+	l, lok := normalizeNumber(literal)
+	r, rok := normalizeNumber(val)
+	if lok || rok {
+		if !lok || !rok {
+			return false
 		}
-		return nil, nil
+		cmp, ok := compareNumbers(l, r)
+		return ok && cmp == 0
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown collection operation: %s", n.Name)
+	if isNull(val) || reflect.ValueOf(literal).Kind() != reflect.ValueOf(val).Kind() {
+		return false
 	}
+	return evaluateEqual(literal, val)
 }
 
-func (n *MethodCall) Evaluate(ctx *Context) (Value, error) {
-	object, err := n.Object.Evaluate(ctx)
-	if err != nil {
-		return nil, err
+func (n *ListPattern) matchValue(val Value, bindings map[string]Value) bool {
+	if isNull(val) {
+		return false
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return false
+	}
+	if rv.Len() != len(n.Elements) {
+		return false
+	}
+	for i, element := range n.Elements {
+		if !element.matchValue(rv.Index(i).Interface(), bindings) {
+			return false
+		}
 	}
+	return true
+}
 
-	args, err := evaluateArgs(n.Arguments, ctx)
-	if err != nil {
-		return nil, err
+func (n *MapPattern) matchValue(val Value, bindings map[string]Value) bool {
+	if isNull(val) {
+		return false
 	}
+	for _, entry := range n.Entries {
+		key, err := entry.Key.Evaluate(nil)
+		if err != nil {
+			return false
+		}
 
-	return callMethod(ctx, object, n.Method, args)
+		var field Value
+		if name, ok := key.(string); ok {
+			field, err = selectField(val, name, n)
+		} else {
+			field, err = indexValue(val, key, n)
+		}
+		if err != nil || !entry.Pattern.matchValue(field, bindings) {
+			return false
+		}
+	}
+	return true
 }
 
-func (n *Filter) Evaluate(ctx *Context) (Value, error) {
-	source, err := n.Source.Evaluate(ctx)
-	if err != nil {
-		return nil, err
+// patternNames returns the variables bound by pat, in source order
+func patternNames(pat Pattern) []string {
+	switch pat := pat.(type) {
+	case *BindPattern:
+		return []string{pat.Name}
+	case *ListPattern:
+		var names []string
+		for _, element := range pat.Elements {
+			names = append(names, patternNames(element)...)
+		}
+		return names
+	case *MapPattern:
+		var names []string
+		for _, entry := range pat.Entries {
+			names = append(names, patternNames(entry.Pattern)...)
+		}
+		return names
 	}
+	return nil
+}
 
-	slice, ok := source.([]Value)
-	if !ok {
-		return nil, fmt.Errorf("filter source must be array, got %T", source)
+func (n *Let) Evaluate(ctx *Context) (Value, error) {
+	scope := ctx.newScope(0)
+	scope.bindings = map[string]*lazyBinding{
+		n.Name: {node: n.Value, ctx: ctx},
 	}
+	return evaluate(scope, n.Body)
+}
 
-	result := make([]Value, 0, len(slice))
-	for _, item := range slice {
-		// Save current variables
-		oldVal := ctx.Variables[n.Variable]
-		ctx.Variables[n.Variable] = item
-
-		keep, err := n.Predicate.Evaluate(ctx)
-		if err != nil {
-			return nil, err
+func (n *Lambda) Evaluate(ctx *Context) (Value, error) {
+	var fn LambdaFunc = func(_ context.Context, args ...Value) (Value, error) {
+		if len(args) != len(n.Params) {
+			return nil, fmt.Errorf("lambda expects %d arguments, got %d", len(n.Params), len(args))
 		}
-
-		if keep.(bool) {
-			result = append(result, item)
+		scope := ctx.newScope(len(n.Params))
+		for i, param := range n.Params {
+			scope.Variables[param] = args[i]
 		}
+		return evaluate(scope, n.Body)
+	}
+	return fn, nil
+}
 
-		// Restore variable
-		if oldVal != nil {
-			ctx.Variables[n.Variable] = oldVal
-		} else {
-			delete(ctx.Variables, n.Variable)
-		}
+func (n *FunctionCall) Evaluate(ctx *Context) (Value, error) {
+	// Check for collection operations that need specialized handling
+	if isMacro(n.Name) {
+		return n.evaluateCollectionOperation(ctx)
 	}
 
-	return result, nil
+	return n.invoke(ctx)
 }
 
-func (n *Map) Evaluate(ctx *Context) (Value, error) {
-	source, err := n.Source.Evaluate(ctx)
+// invoke calls the function with the piped arguments, if any, followed by
+// its own arguments.
+func (n *FunctionCall) invoke(ctx *Context, piped ...Value) (Value, error) {
+	if !hasFunction(ctx, n.Name) {
+		// Variables holding lambdas or functions can be called directly
+		if fn, ok, err := ctx.lookup(n.Name); ok {
+			if err != nil {
+				return nil, err
+			}
+			args, err := evaluateArgs(n.Arguments, ctx)
+			if err != nil {
+				return nil, err
+			}
+			return Invoke(ctx, fn, append(piped, args...)...)
+		}
+		return nil, fmt.Errorf("undefined function: %s", n.Name)
+	}
+
+	args, err := evaluateArgs(n.Arguments, ctx)
 	if err != nil {
 		return nil, err
 	}
+	return callFunction(ctx, n.Name, append(piped, args...))
+}
 
-	slice, ok := source.([]Value)
-	if !ok {
-		return nil, fmt.Errorf("map source must be array, got %T", source)
+// evaluateCollectionOperation handles collection operations with variable
+// scoping. A piped source takes the place of the second argument.
+func (n *FunctionCall) evaluateCollectionOperation(ctx *Context, piped ...Value) (Value, error) {
+	if want := 3 - len(piped); len(n.Arguments) != want {
+		return nil, fmt.Errorf("%s() requires %d arguments", n.Name, want)
 	}
 
-	result := make([]Value, 0, len(slice))
-	for _, item := range slice {
-		// Save current variables
-		oldVal := ctx.Variables[n.Variable]
-		ctx.Variables[n.Variable] = item
+	// Parse variable name
+	variableNode, ok := n.Arguments[0].(*Identifier)
+	if !ok {
+		return nil, fmt.Errorf("%s() first argument must be variable name", n.Name)
+	}
 
-		transformed, err := n.Transform.Evaluate(ctx)
+	var source Value
+	if len(piped) > 0 {
+		source = piped[0]
+	} else {
+		var err error
+		source, err = evaluate(ctx, n.Arguments[1])
 		if err != nil {
 			return nil, err
 		}
-
-		result = append(result, transformed)
-
-		// Restore variable
-		if oldVal != nil {
-			ctx.Variables[n.Variable] = oldVal
-		} else {
-			delete(ctx.Variables, n.Variable)
-		}
 	}
 
-	return result, nil
+	return evaluateMacro(ctx, n.Name, variableNode.Name, source, n.Arguments[len(n.Arguments)-1])
 }
 
-func (n *All) Evaluate(ctx *Context) (Value, error) {
-	source, err := n.Source.Evaluate(ctx)
+func (n *Pipe) Evaluate(ctx *Context) (Value, error) {
+	val, err := evaluate(ctx, n.Value)
 	if err != nil {
 		return nil, err
 	}
 
-	slice, ok := source.([]Value)
-	if !ok {
-		return nil, fmt.Errorf("all source must be array, got %T", source)
+	if isMacro(n.Call.Name) {
+		return n.Call.evaluateCollectionOperation(ctx, val)
 	}
+	return n.Call.invoke(ctx, val)
+}
 
-	for _, item := range slice {
-		// Save current variables
-		oldVal := ctx.Variables[n.Variable]
-		ctx.Variables[n.Variable] = item
+func (n *MethodCall) Evaluate(ctx *Context) (Value, error) {
+	object, err := evaluateReceiver(ctx, n.Object, n.Optional)
+	if err != nil || (n.Optional && isNull(object)) {
+		return nil, err
+	}
 
-		keep, err := n.Predicate.Evaluate(ctx)
-		if err != nil {
-			return nil, err
-		}
+	args, err := evaluateArgs(n.Arguments, ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		if !keep.(bool) {
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[n.Variable] = oldVal
-			} else {
-				delete(ctx.Variables, n.Variable)
-			}
-			return false, nil
-		}
+	return callMethod(ctx, object, n.Method, args)
+}
 
-		// Restore variable
-		if oldVal != nil {
-			ctx.Variables[n.Variable] = oldVal
-		} else {
-			delete(ctx.Variables, n.Variable)
-		}
+func (n *Filter) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
+	if err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	return evaluateMacro(ctx, "filter", n.Variable, source, n.Predicate)
 }
 
-func (n *Exists) Evaluate(ctx *Context) (Value, error) {
-	source, err := n.Source.Evaluate(ctx)
+func (n *Map) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
 	if err != nil {
 		return nil, err
 	}
 
-	slice, ok := source.([]Value)
-	if !ok {
-		return nil, fmt.Errorf("exists source must be array, got %T", source)
+	return evaluateMacro(ctx, "map", n.Variable, source, n.Transform)
+}
+
+func (n *All) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, item := range slice {
-		// Save current variables
-		oldVal := ctx.Variables[n.Variable]
-		ctx.Variables[n.Variable] = item
+	return evaluateMacro(ctx, "all", n.Variable, source, n.Predicate)
+}
 
-		keep, err := n.Predicate.Evaluate(ctx)
-		if err != nil {
-			return nil, err
-		}
+func (n *Exists) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
+	if err != nil {
+		return nil, err
+	}
 
-		if keep.(bool) {
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[n.Variable] = oldVal
-			} else {
-				delete(ctx.Variables, n.Variable)
-			}
-			return true, nil
-		}
+	return evaluateMacro(ctx, "exists", n.Variable, source, n.Predicate)
+}
 
-		// Restore variable
-		if oldVal != nil {
-			ctx.Variables[n.Variable] = oldVal
-		} else {
-			delete(ctx.Variables, n.Variable)
-		}
+func (n *ExistsOne) Evaluate(ctx *Context) (Value, error) {
+	source, err := evaluate(ctx, n.Source)
+	if err != nil {
+		return nil, err
 	}
 
-	return false, nil
+	return evaluateMacro(ctx, "exists_one", n.Variable, source, n.Predicate)
 }
 
 func (n *Find) Evaluate(ctx *Context) (Value, error) {
-	source, err := n.Source.Evaluate(ctx)
+	source, err := evaluate(ctx, n.Source)
 	if err != nil {
 		return nil, err
 	}
 
+	return evaluateMacro(ctx, "find", n.Variable, source, n.Predicate)
+}
+
+// evaluateMacro runs the collection macro op over source, binding each
+// element to variable while body is evaluated. The prefix form
+// filter(x, list, pred) and the receiver form list.filter(x, pred) both
+// evaluate through here so they scope variables identically.
+func evaluateMacro(ctx *Context, op, variable string, source Value, body ASTNode) (Value, error) {
 	slice, ok := source.([]Value)
 	if !ok {
-		return nil, fmt.Errorf("find source must be array, got %T", source)
+		return nil, fmt.Errorf("%s source must be array, got %T", op, source)
 	}
 
-	for _, item := range slice {
-		// Save current variables
-		oldVal := ctx.Variables[n.Variable]
-		ctx.Variables[n.Variable] = item
-
-		found, err := n.Predicate.Evaluate(ctx)
+	// Each element gets its own scope, so that a lambda created in the body
+	// keeps the element it was created for after iteration moves on
+	apply := func(item Value) (Value, error) {
+		scope := ctx.newScope(1)
+		scope.Variables[variable] = item
+		return evaluate(scope, body)
+	}
+	test := func(item Value) (bool, error) {
+		result, err := apply(item)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
+		b, ok := result.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s predicate must be boolean, got %T", op, result)
+		}
+		return b, nil
+	}
 
-		if found.(bool) {
-			// Restore variable
-			if oldVal != nil {
-				ctx.Variables[n.Variable] = oldVal
-			} else {
-				delete(ctx.Variables, n.Variable)
+	switch op {
+	case "filter":
+		result := make([]Value, 0, len(slice))
+		for _, item := range slice {
+			keep, err := test(item)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				result = append(result, item)
 			}
-			return item, nil
 		}
+		return result, nil
 
-		// Restore variable
-		if oldVal != nil {
-			ctx.Variables[n.Variable] = oldVal
-		} else {
-			delete(ctx.Variables, n.Variable)
+	case "map":
+		result := make([]Value, 0, len(slice))
+		for _, item := range slice {
+			transformed, err := apply(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, transformed)
+		}
+		return result, nil
+
+	case "all":
+		for _, item := range slice {
+			keep, err := test(item)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "exists":
+		for _, item := range slice {
+			keep, err := test(item)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "exists_one":
+		count := 0
+		for _, item := range slice {
+			keep, err := test(item)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				if count++; count > 1 {
+					return false, nil
+				}
+			}
 		}
+		return count == 1, nil
+
+	case "find":
+		for _, item := range slice {
+			found, err := test(item)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				return item, nil
+			}
+		}
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown collection operation: %s", op)
 	}
+}
 
-	return nil, nil
+// isMacro reports whether name is a collection macro that binds a variable
+func isMacro(name string) bool {
+	switch name {
+	case "filter", "map", "all", "exists", "exists_one", "find":
+		return true
+	}
+	return false
 }
 
 func (n *Size) Evaluate(ctx *Context) (Value, error) {
-	expr, err := n.Expr.Evaluate(ctx)
+	expr, err := evaluate(ctx, n.Expr)
 	if err != nil {
 		return nil, err
 	}
 
 	switch v := expr.(type) {
 	case []Value:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
 	case string:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
 	case map[string]Value:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
+	case map[Value]Value:
+		return int64(len(v)), nil
+	case []byte:
+		return int64(len(v)), nil
 	default:
 		return nil, fmt.Errorf("size() requires array, string, or map, got %T", expr)
 	}
 }
 
 func (n *First) Evaluate(ctx *Context) (Value, error) {
-	expr, err := n.Expr.Evaluate(ctx)
+	expr, err := evaluate(ctx, n.Expr)
 	if err != nil {
 		return nil, err
 	}
@@ -803,7 +1512,7 @@ func (n *First) Evaluate(ctx *Context) (Value, error) {
 }
 
 func (n *Last) Evaluate(ctx *Context) (Value, error) {
-	expr, err := n.Expr.Evaluate(ctx)
+	expr, err := evaluate(ctx, n.Expr)
 	if err != nil {
 		return nil, err
 	}
@@ -828,7 +1537,7 @@ func (n *Last) Evaluate(ctx *Context) (Value, error) {
 func evaluateArgs(args []ASTNode, ctx *Context) ([]Value, error) {
 	values := make([]Value, 0, len(args))
 	for _, arg := range args {
-		val, err := arg.Evaluate(ctx)
+		val, err := evaluate(ctx, arg)
 		if err != nil {
 			return nil, err
 		}
@@ -840,17 +1549,58 @@ func evaluateArgs(args []ASTNode, ctx *Context) ([]Value, error) {
 func callMethod(ctx *Context, receiver Value, method string, args []Value) (Value, error) {
 	// String methods
 	if str, ok := receiver.(string); ok {
-		return callStringMethod(ctx, str, method, args)
+		if result, ok, err := callStringMethod(ctx, str, method, args); ok {
+			return result, err
+		}
 	}
 
 	// Array methods
 	if arr, ok := receiver.([]Value); ok {
-		return callArrayMethod(ctx, arr, method, args)
+		if result, ok, err := callArrayMethod(ctx, arr, method, args); ok {
+			return result, err
+		}
+	}
+
+	// Any function can be called receiver-style with the receiver as its
+	// first argument, e.g. items.sum() or name.replace("a", "b")
+	if hasFunction(ctx, method) {
+		return callFunction(ctx, method, append([]Value{receiver}, args...))
 	}
 
 	return nil, fmt.Errorf("method %s not available on %T", method, receiver)
 }
 
+// hasFunction reports whether name is a builtin or registered function
+func hasFunction(ctx *Context, name string) bool {
+	if _, ok := builtinFunctions[name]; ok {
+		return true
+	}
+	_, ok := ctx.Functions[name]
+	return ok
+}
+
+// callFunction calls the builtin or registered function name, preferring
+// builtins.
+func callFunction(ctx *Context, name string, args []Value) (Value, error) {
+	// First try built-in functions
+	if fn, ok := builtinFunctions[name]; ok {
+		if fn == nil {
+			return nil, fmt.Errorf("builtin function %s is nil", name)
+		}
+		return fn(ctx, args...)
+	}
+
+	// Then try custom functions
+	if fn, ok := ctx.Functions[name]; ok {
+		if fn == nil {
+			return nil, fmt.Errorf("function %s is nil", name)
+		}
+		return fn.Call(ctx, args...)
+	}
+
+	return nil, fmt.Errorf("undefined function: %s", name)
+}
+
 // StringPool for zero-allocation string operations
 type StringPool struct {
 	pool sync.Pool
@@ -885,6 +1635,51 @@ func NewContext() *Context {
 	}
 }
 
+// newScope returns a child context for local bindings. Variables set on the
+// child shadow, but never modify, those of c.
+func (c *Context) newScope(size int) *Context {
+	return &Context{
+		Variables: make(map[string]Value, size),
+		Functions: c.Functions,
+		timeNow:   c.timeNow,
+		pool:      c.pool,
+		parent:    c,
+	}
+}
+
+// lookup resolves a variable in c and then in its enclosing scopes. The
+// error is set when a let binding fails to evaluate.
+func (c *Context) lookup(name string) (Value, bool, error) {
+	for scope := c; scope != nil; scope = scope.parent {
+		if val, ok := scope.Variables[name]; ok {
+			return val, true, nil
+		}
+		if binding, ok := scope.bindings[name]; ok {
+			val, err := binding.get()
+			return val, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// lazyBinding is a let-bound value that is evaluated in its defining context
+// on first use and memoized for the rest of the evaluation.
+type lazyBinding struct {
+	node  ASTNode
+	ctx   *Context
+	done  bool
+	value Value
+	err   error
+}
+
+func (b *lazyBinding) get() (Value, error) {
+	if !b.done {
+		b.value, b.err = evaluate(b.ctx, b.node)
+		b.done = true
+	}
+	return b.value, b.err
+}
+
 // RegisterFunction registers a custom function
 func (c *Context) RegisterFunction(name string, fn Function) {
 	c.Functions[name] = fn
@@ -904,6 +1699,7 @@ var builtinFunctions = map[string]func(context.Context, ...Value) (Value, error)
 	"trim":         stringTrim,
 	"replace":      stringReplace,
 	"split":        stringSplit,
+	"format":       stringFormat,
 	"matches":      stringMatches,
 	"findAll":      stringFindAll,
 	"replaceRegex": stringReplaceRegex,
@@ -915,6 +1711,7 @@ var builtinFunctions = map[string]func(context.Context, ...Value) (Value, error)
 	"round": mathRound,
 	"sqrt":  mathSqrt,
 	"pow":   mathPow,
+	"xor":   mathXor,
 	"min":   mathMin,
 	"max":   mathMax,
 
@@ -947,6 +1744,7 @@ var builtinFunctions = map[string]func(context.Context, ...Value) (Value, error)
 	// Type functions
 	"type":     typeType,
 	"int":      typeInt,
+	"uint":     typeUint,
 	"double":   typeDouble,
 	"string":   typeString,
 	"toString": typeToString,
@@ -0,0 +1,547 @@
+package cel
+
+import "sort"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk. If
+// the result visitor w is not nil, Walk visits each of the children of node
+// with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node ASTNode) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order, children in source order
+func Walk(v Visitor, node ASTNode) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range Children(node) {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(ASTNode) bool
+
+func (f inspector) Visit(node ASTNode) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order, calling f for each node. If
+// f returns true, Inspect continues with the children of node, followed by a
+// call of f(nil).
+func Inspect(node ASTNode, f func(ASTNode) bool) {
+	Walk(inspector(f), node)
+}
+
+// Children returns the direct child nodes of node in source order. Omitted
+// slice bounds, absent match guards and absent comprehension conditions are
+// left out. Match patterns are not nodes, so they are never included.
+func Children(node ASTNode) []ASTNode {
+	switch n := node.(type) {
+	case *ArrayLiteral:
+		return n.Elements
+	case *MapLiteral:
+		children := make([]ASTNode, 0, 2*len(n.Pairs))
+		for _, pair := range n.Pairs {
+			children = append(children, pair.Key)
+			if pair.Value != nil {
+				children = append(children, pair.Value)
+			}
+		}
+		return children
+	case *Spread:
+		return []ASTNode{n.Value}
+	case *Template:
+		return n.Exprs
+	case *Select:
+		return []ASTNode{n.Operand}
+	case *Index:
+		return []ASTNode{n.Operand, n.Index}
+	case *Slice:
+		children := []ASTNode{n.Operand}
+		if n.Start != nil {
+			children = append(children, n.Start)
+		}
+		if n.End != nil {
+			children = append(children, n.End)
+		}
+		return children
+	case *BinaryOp:
+		return []ASTNode{n.Left, n.Right}
+	case *UnaryOp:
+		return []ASTNode{n.Expr}
+	case *Between:
+		return []ASTNode{n.Expr, n.Low, n.High}
+	case *Ternary:
+		return []ASTNode{n.Cond, n.Then, n.Else}
+	case *Comprehension:
+		children := []ASTNode{n.Key}
+		if n.Value != nil {
+			children = append(children, n.Value)
+		}
+		children = append(children, n.Source)
+		if n.Cond != nil {
+			children = append(children, n.Cond)
+		}
+		return children
+	case *Match:
+		children := []ASTNode{n.Subject}
+		for _, arm := range n.Arms {
+			if arm.Guard != nil {
+				children = append(children, arm.Guard)
+			}
+			children = append(children, arm.Body)
+		}
+		return children
+	case *Let:
+		return []ASTNode{n.Value, n.Body}
+	case *Lambda:
+		return []ASTNode{n.Body}
+	case *FunctionCall:
+		return n.Arguments
+	case *MethodCall:
+		return append([]ASTNode{n.Object}, n.Arguments...)
+	case *Pipe:
+		return []ASTNode{n.Value, n.Call}
+	case *Filter:
+		return []ASTNode{n.Source, n.Predicate}
+	case *Map:
+		return []ASTNode{n.Source, n.Transform}
+	case *All:
+		return []ASTNode{n.Source, n.Predicate}
+	case *Exists:
+		return []ASTNode{n.Source, n.Predicate}
+	case *ExistsOne:
+		return []ASTNode{n.Source, n.Predicate}
+	case *Find:
+		return []ASTNode{n.Source, n.Predicate}
+	case *Size:
+		return []ASTNode{n.Expr}
+	case *First:
+		return []ASTNode{n.Expr}
+	case *Last:
+		return []ASTNode{n.Expr}
+	}
+	return nil
+}
+
+// Rewrite returns a copy of the AST in which every node has been replaced by
+// the result of f. Nodes are visited bottom-up, so f sees each node with its
+// children already rewritten; returning the node unchanged keeps it. The
+// call of a Pipe can only be replaced by another *FunctionCall. The
+// original AST is not modified. Copies keep their span in the original
+// source unless something below them was replaced, in which case the span
+// is cleared, as it no longer describes their text. Nodes returned by f are
+// used as they are, spans included.
+func Rewrite(node ASTNode, f func(ASTNode) ASTNode) ASTNode {
+	var changed bool
+	return rewrite(node, f, &changed)
+}
+
+// rewrite is Rewrite, setting *changed if f replaced any node
+func rewrite(node ASTNode, f func(ASTNode) ASTNode, changed *bool) ASTNode {
+	if node == nil {
+		return nil
+	}
+	c := rewriteCopy(node, f, changed)
+	rewritten := f(c)
+	*changed = *changed || rewritten != c
+	return rewritten
+}
+
+// rewriteCopy returns a copy of node with its children rewritten, clearing
+// its span if any of them changed
+func rewriteCopy(node ASTNode, f func(ASTNode) ASTNode, changed *bool) ASTNode {
+	var inner bool
+	c := rewriteChildren(node, f, &inner)
+	if inner {
+		if spanned, ok := c.(interface{ setSpan(Span) }); ok {
+			spanned.setSpan(Span{})
+		}
+		*changed = true
+	}
+	return c
+}
+
+func rewriteAll(nodes []ASTNode, f func(ASTNode) ASTNode, changed *bool) []ASTNode {
+	if nodes == nil {
+		return nil
+	}
+	rewritten := make([]ASTNode, len(nodes))
+	for i, node := range nodes {
+		rewritten[i] = rewrite(node, f, changed)
+	}
+	return rewritten
+}
+
+// rewriteChildren returns a shallow copy of node with its children rewritten
+func rewriteChildren(node ASTNode, f func(ASTNode) ASTNode, changed *bool) ASTNode {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		c := *n
+		return &c
+	case *IntLiteral:
+		c := *n
+		return &c
+	case *UintLiteral:
+		c := *n
+		return &c
+	case *StringLiteral:
+		c := *n
+		return &c
+	case *BytesLiteral:
+		c := *n
+		return &c
+	case *BooleanLiteral:
+		c := *n
+		return &c
+	case *NullLiteral:
+		c := *n
+		return &c
+	case *Identifier:
+		c := *n
+		return &c
+	case *BadExpr:
+		c := *n
+		return &c
+	case *ArrayLiteral:
+		c := *n
+		c.Elements = rewriteAll(n.Elements, f, changed)
+		return &c
+	case *MapLiteral:
+		c := *n
+		c.Pairs = make([]MapPair, len(n.Pairs))
+		for i, pair := range n.Pairs {
+			c.Pairs[i] = MapPair{Key: rewrite(pair.Key, f, changed), Value: rewrite(pair.Value, f, changed)}
+		}
+		return &c
+	case *Template:
+		c := *n
+		c.Text = append([]string(nil), n.Text...)
+		c.Exprs = rewriteAll(n.Exprs, f, changed)
+		return &c
+	case *Select:
+		c := *n
+		c.Operand = rewrite(n.Operand, f, changed)
+		return &c
+	case *Index:
+		c := *n
+		c.Operand = rewrite(n.Operand, f, changed)
+		c.Index = rewrite(n.Index, f, changed)
+		return &c
+	case *Slice:
+		c := *n
+		c.Operand = rewrite(n.Operand, f, changed)
+		c.Start = rewrite(n.Start, f, changed)
+		c.End = rewrite(n.End, f, changed)
+		return &c
+	case *BinaryOp:
+		c := *n
+		c.Left = rewrite(n.Left, f, changed)
+		c.Right = rewrite(n.Right, f, changed)
+		return &c
+	case *UnaryOp:
+		c := *n
+		c.Expr = rewrite(n.Expr, f, changed)
+		return &c
+	case *Between:
+		c := *n
+		c.Expr = rewrite(n.Expr, f, changed)
+		c.Low = rewrite(n.Low, f, changed)
+		c.High = rewrite(n.High, f, changed)
+		return &c
+	case *Ternary:
+		c := *n
+		c.Cond = rewrite(n.Cond, f, changed)
+		c.Then = rewrite(n.Then, f, changed)
+		c.Else = rewrite(n.Else, f, changed)
+		return &c
+	case *Spread:
+		c := *n
+		c.Value = rewrite(n.Value, f, changed)
+		return &c
+	case *Comprehension:
+		c := *n
+		c.Key = rewrite(n.Key, f, changed)
+		c.Value = rewrite(n.Value, f, changed)
+		c.Variables = append([]string(nil), n.Variables...)
+		c.Source = rewrite(n.Source, f, changed)
+		c.Cond = rewrite(n.Cond, f, changed)
+		return &c
+	case *Match:
+		c := *n
+		c.Subject = rewrite(n.Subject, f, changed)
+		c.Arms = make([]MatchArm, len(n.Arms))
+		for i, arm := range n.Arms {
+			c.Arms[i] = MatchArm{Pattern: arm.Pattern, Guard: rewrite(arm.Guard, f, changed), Body: rewrite(arm.Body, f, changed)}
+		}
+		return &c
+	case *Let:
+		c := *n
+		c.Value = rewrite(n.Value, f, changed)
+		c.Body = rewrite(n.Body, f, changed)
+		return &c
+	case *Lambda:
+		c := *n
+		c.Params = append([]string(nil), n.Params...)
+		c.Body = rewrite(n.Body, f, changed)
+		return &c
+	case *FunctionCall:
+		c := *n
+		c.Arguments = rewriteAll(n.Arguments, f, changed)
+		return &c
+	case *MethodCall:
+		c := *n
+		c.Object = rewrite(n.Object, f, changed)
+		c.Arguments = rewriteAll(n.Arguments, f, changed)
+		return &c
+	case *Pipe:
+		c := *n
+		c.Value = rewrite(n.Value, f, changed)
+		rewritten := rewriteCopy(n.Call, f, changed).(*FunctionCall)
+		if call, ok := f(rewritten).(*FunctionCall); ok {
+			*changed = *changed || call != rewritten
+			rewritten = call
+		}
+		c.Call = rewritten
+		return &c
+	case *Filter:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Predicate = rewrite(n.Predicate, f, changed)
+		return &c
+	case *Map:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Transform = rewrite(n.Transform, f, changed)
+		return &c
+	case *All:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Predicate = rewrite(n.Predicate, f, changed)
+		return &c
+	case *Exists:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Predicate = rewrite(n.Predicate, f, changed)
+		return &c
+	case *ExistsOne:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Predicate = rewrite(n.Predicate, f, changed)
+		return &c
+	case *Find:
+		c := *n
+		c.Source = rewrite(n.Source, f, changed)
+		c.Predicate = rewrite(n.Predicate, f, changed)
+		return &c
+	case *Size:
+		c := *n
+		c.Expr = rewrite(n.Expr, f, changed)
+		return &c
+	case *First:
+		c := *n
+		c.Expr = rewrite(n.Expr, f, changed)
+		return &c
+	case *Last:
+		c := *n
+		c.Expr = rewrite(n.Expr, f, changed)
+		return &c
+	}
+	return node
+}
+
+// NewExpression returns an expression that evaluates the given AST, such as
+// one built or rewritten by hand
+func NewExpression(ast ASTNode) *Expression {
+	return &Expression{ast: ast}
+}
+
+// Rewrite returns a new expression whose AST is Rewrite(e.AST(), f). If f
+// replaced any node, the new expression drops the source text: replacements
+// may have been parsed from other source, so their spans say nothing about
+// this one, and evaluation errors are then reported without a snippet.
+func (e *Expression) Rewrite(f func(ASTNode) ASTNode) *Expression {
+	var changed bool
+	rewritten := &Expression{ast: rewrite(e.ast, f, &changed)}
+	if !changed {
+		rewritten.source = e.source
+	}
+	return rewritten
+}
+
+// References lists the inputs an expression depends on
+type References struct {
+	// Variables are the top-level variables read, e.g. user
+	Variables []string
+
+	// Fields are the full field paths selected from those variables, e.g.
+	// user.address.city
+	Fields []string
+
+	// Functions are the names of the functions and methods called, e.g.
+	// custom_func
+	Functions []string
+}
+
+// References returns the variables, field paths and functions the
+// expression refers to, each sorted and without duplicates. Names bound
+// inside the expression, such as macro and lambda parameters and let
+// bindings, are not included.
+func (e *Expression) References() References {
+	c := &referenceCollector{
+		bound:     make(map[string]int),
+		variables: make(map[string]bool),
+		fields:    make(map[string]bool),
+		functions: make(map[string]bool),
+	}
+	if e.ast != nil {
+		c.collect(e.ast)
+	}
+	return References{
+		Variables: sortedKeys(c.variables),
+		Fields:    sortedKeys(c.fields),
+		Functions: sortedKeys(c.functions),
+	}
+}
+
+type referenceCollector struct {
+	bound     map[string]int
+	variables map[string]bool
+	fields    map[string]bool
+	functions map[string]bool
+}
+
+// collectBound collects node with names bound for its duration
+func (c *referenceCollector) collectBound(node ASTNode, names ...string) {
+	for _, name := range names {
+		c.bound[name]++
+	}
+	c.collect(node)
+	for _, name := range names {
+		c.bound[name]--
+	}
+}
+
+func (c *referenceCollector) collectMacro(source ASTNode, variable string, body ASTNode) {
+	c.collect(source)
+	c.collectBound(body, variable)
+}
+
+func (c *referenceCollector) collect(node ASTNode) {
+	switch n := node.(type) {
+	case *Identifier:
+		if c.bound[n.Name] == 0 {
+			c.variables[n.Name] = true
+		}
+		return
+	case *Select:
+		if root, path, ok := selectPath(n); ok {
+			if c.bound[root] == 0 {
+				c.variables[root] = true
+				c.fields[path] = true
+			}
+			return
+		}
+	case *Let:
+		c.collect(n.Value)
+		c.collectBound(n.Body, n.Name)
+		return
+	case *Comprehension:
+		c.collect(n.Source)
+		for _, child := range []ASTNode{n.Key, n.Value, n.Cond} {
+			if child != nil {
+				c.collectBound(child, n.Variables...)
+			}
+		}
+		return
+	case *Match:
+		c.collect(n.Subject)
+		for _, arm := range n.Arms {
+			names := patternNames(arm.Pattern)
+			if arm.Guard != nil {
+				c.collectBound(arm.Guard, names...)
+			}
+			c.collectBound(arm.Body, names...)
+		}
+		return
+	case *Lambda:
+		c.collectBound(n.Body, n.Params...)
+		return
+	case *Filter:
+		c.collectMacro(n.Source, n.Variable, n.Predicate)
+		return
+	case *Map:
+		c.collectMacro(n.Source, n.Variable, n.Transform)
+		return
+	case *All:
+		c.collectMacro(n.Source, n.Variable, n.Predicate)
+		return
+	case *Exists:
+		c.collectMacro(n.Source, n.Variable, n.Predicate)
+		return
+	case *ExistsOne:
+		c.collectMacro(n.Source, n.Variable, n.Predicate)
+		return
+	case *Find:
+		c.collectMacro(n.Source, n.Variable, n.Predicate)
+		return
+	case *Pipe:
+		// Piped macros such as numbers |> filter(n, n > 5)
+		if isMacro(n.Call.Name) && len(n.Call.Arguments) == 2 {
+			if variable, ok := n.Call.Arguments[0].(*Identifier); ok {
+				c.collectMacro(n.Value, variable.Name, n.Call.Arguments[1])
+				return
+			}
+		}
+	case *FunctionCall:
+		// Function-style macros such as filter(n, numbers, n > 5)
+		if isMacro(n.Name) && len(n.Arguments) == 3 {
+			if variable, ok := n.Arguments[0].(*Identifier); ok {
+				c.collectMacro(n.Arguments[1], variable.Name, n.Arguments[2])
+				return
+			}
+		}
+		if c.bound[n.Name] == 0 {
+			c.functions[n.Name] = true
+		}
+	case *MethodCall:
+		c.functions[n.Method] = true
+	case *Size:
+		c.functions["size"] = true
+	case *First:
+		c.functions["first"] = true
+	case *Last:
+		c.functions["last"] = true
+	}
+
+	for _, child := range Children(node) {
+		c.collect(child)
+	}
+}
+
+// selectPath returns the root variable and dotted path of a chain of field
+// selections such as user.address.city
+func selectPath(n *Select) (root, path string, ok bool) {
+	switch operand := n.Operand.(type) {
+	case *Identifier:
+		return operand.Name, operand.Name + "." + n.Field, true
+	case *Select:
+		if root, path, ok := selectPath(operand); ok {
+			return root, path + "." + n.Field, true
+		}
+	}
+	return "", "", false
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
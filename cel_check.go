@@ -0,0 +1,173 @@
+package cel
+
+import (
+	"fmt"
+	"math"
+)
+
+// Warning is a likely mistake found by Check that does not prevent the
+// expression from being evaluated, such as a match arm that can never be
+// selected
+type Warning struct {
+	Span    Span
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s (at position %d)", w.Message, w.Span.Start)
+}
+
+// Check reports likely mistakes that are not syntax errors, in source
+// order. For match expressions it reports arms that can never be selected:
+// arms after a catch-all, repeated literal patterns, patterns of a different
+// type than a subject whose type is known statically, such as a comparison
+// or a literal, and a default arm made unreachable by matching both true
+// and false. Exhaustiveness needs no check, as the parser already requires
+// every match to end with a catch-all arm.
+func (e *Expression) Check() []Warning {
+	if e.ast == nil {
+		return nil
+	}
+	var warnings []Warning
+	Inspect(e.ast, func(node ASTNode) bool {
+		if match, ok := node.(*Match); ok {
+			warnings = append(warnings, checkMatch(match)...)
+		}
+		return true
+	})
+	return warnings
+}
+
+func checkMatch(n *Match) []Warning {
+	var warnings []Warning
+	warn := func(pattern Pattern, format string, args ...any) {
+		warnings = append(warnings, Warning{Span: pattern.Span(), Message: fmt.Sprintf(format, args...)})
+	}
+
+	subjectType := staticType(n.Subject)
+	seen := make(map[string]bool)
+	for i, arm := range n.Arms {
+		if i > 0 && isCatchAll(n.Arms[i-1]) {
+			warn(arm.Pattern, "unreachable match arm: an earlier arm matches every value")
+			break
+		}
+
+		if patternType := staticPatternType(arm.Pattern); subjectType != "" && patternType != "" &&
+			!compatibleTypes(subjectType, patternType) {
+			warn(arm.Pattern, "pattern %s can never match a subject of type %s", arm.Pattern, subjectType)
+			continue
+		}
+
+		if literal, ok := arm.Pattern.(*LiteralPattern); ok && arm.Guard == nil {
+			key := literalKey(literal.Literal)
+			if seen[key] {
+				warn(arm.Pattern, "unreachable match arm: pattern %s is already matched", arm.Pattern)
+			}
+			seen[key] = true
+		}
+	}
+
+	if subjectType == "bool" && seen["bool:true"] && seen["bool:false"] {
+		last := n.Arms[len(n.Arms)-1]
+		if isCatchAll(last) {
+			warn(last.Pattern, "unreachable default arm: true and false are both matched")
+		}
+	}
+	return warnings
+}
+
+// staticType returns the type a node always evaluates to, such as "bool"
+// for a comparison, or "" if it is not known without evaluating it
+func staticType(node ASTNode) string {
+	switch n := node.(type) {
+	case *BooleanLiteral, *Between, *All, *Exists, *ExistsOne:
+		return "bool"
+	case *IntLiteral, *Size:
+		return "int"
+	case *UintLiteral:
+		return "uint"
+	case *NumberLiteral:
+		return "double"
+	case *StringLiteral, *Template:
+		return "string"
+	case *BytesLiteral:
+		return "bytes"
+	case *NullLiteral:
+		return "null"
+	case *ArrayLiteral, *Filter, *Map:
+		return "list"
+	case *MapLiteral:
+		return "map"
+	case *Comprehension:
+		if n.Value == nil {
+			return "list"
+		}
+		return "map"
+	case *UnaryOp:
+		if n.Op == "!" {
+			return "bool"
+		}
+	case *BinaryOp:
+		switch n.Op {
+		case "==", "!=", "<", "<=", ">", ">=", "in", "&&", "||":
+			return "bool"
+		}
+	}
+	return ""
+}
+
+// staticPatternType returns the type of value a pattern can match, or "" if
+// it can match any value
+func staticPatternType(pattern Pattern) string {
+	switch pat := pattern.(type) {
+	case *LiteralPattern:
+		return staticType(pat.Literal)
+	case *ListPattern:
+		return "list"
+	case *MapPattern:
+		return "map"
+	}
+	return ""
+}
+
+// compatibleTypes reports whether values of the two static types can be
+// equal. Numbers compare equal across int, uint and double.
+func compatibleTypes(a, b string) bool {
+	return a == b || (isNumericType(a) && isNumericType(b))
+}
+
+func isNumericType(t string) bool {
+	switch t {
+	case "int", "uint", "double":
+		return true
+	}
+	return false
+}
+
+// literalKey identifies the values a literal pattern matches, such as
+// "bool:true". Numbers that compare equal, such as 1, 1u and 1.0, share
+// a key.
+func literalKey(literal ASTNode) string {
+	val := mustEvaluate(literal)
+	n, ok := normalizeNumber(val)
+	if !ok {
+		return staticType(literal) + ":" + fmt.Sprint(val)
+	}
+	switch v := n.(type) {
+	case uint64:
+		if v <= math.MaxInt64 {
+			n = int64(v)
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			n = int64(v)
+		}
+	}
+	return fmt.Sprintf("number:%v", n)
+}
+
+// mustEvaluate evaluates a literal, which needs no context and cannot fail
+func mustEvaluate(literal ASTNode) Value {
+	val, _ := literal.Evaluate(nil)
+	return val
+}
@@ -1,8 +1,12 @@
 package cel
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,6 +26,8 @@ func evaluateBinaryOp(op string, left, right Value, _ *Context) (Value, error) {
 		return evaluateModulo(left, right)
 	case "^":
 		return evaluatePower(left, right)
+	case "&", "|", "<<", ">>":
+		return evaluateBitwise(op, left, right)
 	case "==":
 		return evaluateEqual(left, right), nil
 	case "!=":
@@ -34,6 +40,8 @@ func evaluateBinaryOp(op string, left, right Value, _ *Context) (Value, error) {
 		return evaluateGreaterThan(left, right), nil
 	case ">=":
 		return evaluateGreaterThanOrEqual(left, right), nil
+	case "in":
+		return evaluateIn(left, right)
 	case "&&":
 		return evaluateAnd(left, right), nil
 	case "||":
@@ -50,6 +58,8 @@ func evaluateUnaryOp(op string, expr Value, _ *Context) (Value, error) {
 		return evaluateNot(expr), nil
 	case "-":
 		return evaluateNegate(expr)
+	case "~":
+		return evaluateComplement(expr)
 	default:
 		return nil, fmt.Errorf("unknown unary operator: %s", op)
 	}
@@ -57,52 +67,38 @@ func evaluateUnaryOp(op string, expr Value, _ *Context) (Value, error) {
 
 // Arithmetic operations
 func evaluateAdd(left, right Value) (Value, error) {
+	if result, ok, err := evaluateArithmetic("+", left, right); ok {
+		return result, err
+	}
+
 	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv + rv, nil
-		case int:
-			return lv + float64(rv), nil
-		case string:
-			return fmt.Sprintf("%v%v", lv, rv), nil
-		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) + rv, nil
-		case int:
-			return lv + rv, nil
-		case string:
-			return fmt.Sprintf("%v%v", lv, rv), nil
-		}
 	case string:
 		return lv + fmt.Sprintf("%v", right), nil
 	case time.Time:
 		if dur, ok := right.(time.Duration); ok {
 			return lv.Add(dur), nil
 		}
+	case time.Duration:
+		if rv, ok := right.(time.Duration); ok {
+			return lv + rv, nil
+		}
+	}
+
+	if rv, ok := right.(string); ok {
+		if _, isNum := normalizeNumber(left); isNum {
+			return fmt.Sprintf("%v%v", left, rv), nil
+		}
 	}
 
 	return nil, fmt.Errorf("invalid operands for + operator: %T + %T", left, right)
 }
 
 func evaluateSubtract(left, right Value) (Value, error) {
+	if result, ok, err := evaluateArithmetic("-", left, right); ok {
+		return result, err
+	}
+
 	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv - rv, nil
-		case int:
-			return lv - float64(rv), nil
-		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) - rv, nil
-		case int:
-			return lv - rv, nil
-		}
 	case time.Time:
 		if rv, ok := right.(time.Time); ok {
 			return lv.Sub(rv), nil
@@ -120,99 +116,330 @@ func evaluateSubtract(left, right Value) (Value, error) {
 }
 
 func evaluateMultiply(left, right Value) (Value, error) {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
+	if result, ok, err := evaluateArithmetic("*", left, right); ok {
+		return result, err
+	}
+
+	return nil, fmt.Errorf("invalid operands for * operator: %T * %T", left, right)
+}
+
+func evaluateDivide(left, right Value) (Value, error) {
+	if result, ok, err := evaluateArithmetic("/", left, right); ok {
+		return result, err
+	}
+
+	return nil, fmt.Errorf("invalid operands for / operator: %T / %T", left, right)
+}
+
+func evaluateModulo(left, right Value) (Value, error) {
+	if result, ok, err := evaluateArithmetic("%", left, right); ok {
+		return result, err
+	}
+
+	return nil, fmt.Errorf("invalid operands for %% operator: %T %% %T", left, right)
+}
+
+func evaluatePower(left, right Value) (Value, error) {
+	if result, ok, err := evaluateArithmetic("^", left, right); ok {
+		return result, err
+	}
+
+	return nil, fmt.Errorf("invalid operands for ^ operator: %T ^ %T", left, right)
+}
+
+// evaluateArithmetic applies op to two numbers, reporting ok=false when
+// either operand is not a number. int and uint operands keep their type,
+// with integer division truncating and overflow reported as an error.
+// Mixing either with a double yields a double; mixing int with uint is an
+// error, as in CEL. An integer power with a negative exponent is an error
+// rather than a double, so the result type never depends on a value.
+func evaluateArithmetic(op string, left, right Value) (Value, bool, error) {
+	l, ok := normalizeNumber(left)
+	if !ok {
+		return nil, false, nil
+	}
+	r, ok := normalizeNumber(right)
+	if !ok {
+		return nil, false, nil
+	}
+
+	switch lv := l.(type) {
+	case int64:
+		switch rv := r.(type) {
+		case int64:
+			result, err := intArithmetic(op, lv, rv)
+			return result, true, err
 		case float64:
-			return lv * rv, nil
-		case int:
-			return lv * float64(rv), nil
+			result, err := doubleArithmetic(op, float64(lv), rv)
+			return result, true, err
 		}
-	case int:
-		switch rv := right.(type) {
+	case uint64:
+		switch rv := r.(type) {
+		case uint64:
+			result, err := uintArithmetic(op, lv, rv)
+			return result, true, err
 		case float64:
-			return float64(lv) * rv, nil
-		case int:
-			return lv * rv, nil
+			result, err := doubleArithmetic(op, float64(lv), rv)
+			return result, true, err
 		}
+	case float64:
+		result, err := doubleArithmetic(op, lv, toDouble(r))
+		return result, true, err
 	}
 
-	return nil, fmt.Errorf("invalid operands for * operator: %T * %T", left, right)
+	return nil, true, fmt.Errorf("invalid operands for %s operator: int and uint cannot be mixed (%v %s %v)", op, left, op, right)
 }
 
-func evaluateDivide(left, right Value) (Value, error) {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			if rv == 0 {
-				return nil, fmt.Errorf("division by zero")
+func intArithmetic(op string, a, b int64) (Value, error) {
+	switch op {
+	case "+":
+		if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+			return nil, fmt.Errorf("integer overflow: %d + %d", a, b)
+		}
+		return a + b, nil
+	case "-":
+		if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+			return nil, fmt.Errorf("integer overflow: %d - %d", a, b)
+		}
+		return a - b, nil
+	case "*":
+		if a == 0 || b == 0 {
+			return int64(0), nil
+		}
+		result := a * b
+		if result/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+			return nil, fmt.Errorf("integer overflow: %d * %d", a, b)
+		}
+		return result, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			return nil, fmt.Errorf("integer overflow: %d / %d", a, b)
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("modulus by zero")
+		}
+		if a == math.MinInt64 && b == -1 {
+			return nil, fmt.Errorf("integer overflow: %d %% %d", a, b)
+		}
+		return a % b, nil
+	case "^":
+		if b < 0 {
+			return nil, fmt.Errorf("negative exponent in integer power: %d ^ %d, use a double base", a, b)
+		}
+		result, base, exp := int64(1), a, b
+		for {
+			if exp&1 == 1 {
+				next, err := intArithmetic("*", result, base)
+				if err != nil {
+					return nil, fmt.Errorf("integer overflow: %d ^ %d", a, b)
+				}
+				result = next.(int64)
+			}
+			if exp >>= 1; exp == 0 {
+				return result, nil
 			}
-			return lv / rv, nil
-		case int:
-			if rv == 0 {
-				return nil, fmt.Errorf("division by zero")
+			next, err := intArithmetic("*", base, base)
+			if err != nil {
+				return nil, fmt.Errorf("integer overflow: %d ^ %d", a, b)
 			}
-			return lv / float64(rv), nil
+			base = next.(int64)
 		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			if rv == 0 {
-				return nil, fmt.Errorf("division by zero")
+	}
+	return nil, fmt.Errorf("unknown arithmetic operator: %s", op)
+}
+
+func uintArithmetic(op string, a, b uint64) (Value, error) {
+	switch op {
+	case "+":
+		if a > math.MaxUint64-b {
+			return nil, fmt.Errorf("unsigned integer overflow: %d + %d", a, b)
+		}
+		return a + b, nil
+	case "-":
+		if b > a {
+			return nil, fmt.Errorf("unsigned integer overflow: %d - %d", a, b)
+		}
+		return a - b, nil
+	case "*":
+		if a == 0 || b == 0 {
+			return uint64(0), nil
+		}
+		result := a * b
+		if result/b != a {
+			return nil, fmt.Errorf("unsigned integer overflow: %d * %d", a, b)
+		}
+		return result, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("modulus by zero")
+		}
+		return a % b, nil
+	case "^":
+		result, base, exp := uint64(1), a, b
+		for {
+			if exp&1 == 1 {
+				next, err := uintArithmetic("*", result, base)
+				if err != nil {
+					return nil, fmt.Errorf("unsigned integer overflow: %d ^ %d", a, b)
+				}
+				result = next.(uint64)
 			}
-			return float64(lv) / rv, nil
-		case int:
-			if rv == 0 {
-				return nil, fmt.Errorf("division by zero")
+			if exp >>= 1; exp == 0 {
+				return result, nil
 			}
-			return lv / rv, nil
+			next, err := uintArithmetic("*", base, base)
+			if err != nil {
+				return nil, fmt.Errorf("unsigned integer overflow: %d ^ %d", a, b)
+			}
+			base = next.(uint64)
 		}
 	}
+	return nil, fmt.Errorf("unknown arithmetic operator: %s", op)
+}
 
-	return nil, fmt.Errorf("invalid operands for / operator: %T / %T", left, right)
+func doubleArithmetic(op string, a, b float64) (Value, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		return math.Mod(a, b), nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("unknown arithmetic operator: %s", op)
 }
 
-func evaluateModulo(left, right Value) (Value, error) {
-	switch lv := left.(type) {
+// normalizeNumber converts any Go numeric value to int64, uint64 or
+// float64, the three numeric types expressions operate on.
+func normalizeNumber(v Value) (Value, bool) {
+	switch n := v.(type) {
+	case int64, uint64, float64:
+		return n, true
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case uint:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case uint16:
+		return uint64(n), true
+	case uint8:
+		return uint64(n), true
+	case float32:
+		return float64(n), true
+	}
+	return nil, false
+}
+
+// toDouble converts a normalized number to float64
+func toDouble(n Value) float64 {
+	switch v := n.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
 	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return math.Mod(lv, rv), nil
-		case int:
-			return math.Mod(lv, float64(rv)), nil
+		return v
+	}
+	return 0
+}
+
+func toFloat(v Value) (float64, bool) {
+	n, ok := normalizeNumber(v)
+	if !ok {
+		return 0, false
+	}
+	return toDouble(n), true
+}
+
+// toInt64 converts an int, a uint that fits in int64, or an integral double
+// to int64
+func toInt64(v Value) (int64, bool) {
+	n, ok := normalizeNumber(v)
+	if !ok {
+		return 0, false
+	}
+	switch i := n.(type) {
+	case int64:
+		return i, true
+	case uint64:
+		if i <= math.MaxInt64 {
+			return int64(i), true
 		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return math.Mod(float64(lv), rv), nil
-		case int:
-			return lv % rv, nil
+	case float64:
+		if i == math.Trunc(i) && i >= math.MinInt64 && i < math.MaxInt64 {
+			return int64(i), true
 		}
 	}
-
-	return nil, fmt.Errorf("invalid operands for %% operator")
+	return 0, false
 }
 
-func evaluatePower(left, right Value) (Value, error) {
+// compareNumbers orders two normalized numbers. ok is false when either is
+// NaN.
+func compareNumbers(left, right Value) (int, bool) {
 	switch lv := left.(type) {
-	case float64:
+	case int64:
 		switch rv := right.(type) {
-		case float64:
-			return math.Pow(lv, rv), nil
-		case int:
-			return math.Pow(lv, float64(rv)), nil
+		case int64:
+			return cmpOrdered(lv, rv), true
+		case uint64:
+			if lv < 0 {
+				return -1, true
+			}
+			return cmpOrdered(uint64(lv), rv), true
 		}
-	case int:
+	case uint64:
 		switch rv := right.(type) {
-		case float64:
-			return math.Pow(float64(lv), rv), nil
-		case int:
-			return math.Pow(float64(lv), float64(rv)), nil
+		case uint64:
+			return cmpOrdered(lv, rv), true
+		case int64:
+			if rv < 0 {
+				return 1, true
+			}
+			return cmpOrdered(lv, uint64(rv)), true
 		}
 	}
 
-	return nil, fmt.Errorf("invalid operands for ^ operator: %T ^ %T", left, right)
+	lf, rf := toDouble(left), toDouble(right)
+	if math.IsNaN(lf) || math.IsNaN(rf) {
+		return 0, false
+	}
+	return cmpOrdered(lf, rf), true
+}
+
+func cmpOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
 }
 
 // Comparison operations
@@ -223,119 +450,131 @@ func evaluateEqual(left, right Value) bool {
 	if left == nil || right == nil {
 		return false
 	}
+	if l, ok := normalizeNumber(left); ok {
+		if r, ok := normalizeNumber(right); ok {
+			cmp, ok := compareNumbers(l, r)
+			return ok && cmp == 0
+		}
+	}
 	return fmt.Sprintf("%v", left) == fmt.Sprintf("%v", right)
 }
 
 func evaluateLessThan(left, right Value) bool {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv < rv
-		case int:
-			return lv < float64(rv)
-		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) < rv
-		case int:
-			return lv < rv
-		}
-	case string:
-		if rv, ok := right.(string); ok {
-			return lv < rv
-		}
-	case time.Time:
-		if rv, ok := right.(time.Time); ok {
-			return lv.Before(rv)
-		}
-	}
-	return false
+	cmp, err := compareValues(left, right)
+	return err == nil && cmp < 0
 }
 
 func evaluateLessThanOrEqual(left, right Value) bool {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv <= rv
-		case int:
-			return lv <= float64(rv)
-		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) <= rv
-		case int:
-			return lv <= rv
-		}
-	case string:
-		if rv, ok := right.(string); ok {
-			return lv <= rv
-		}
-	case time.Time:
-		if rv, ok := right.(time.Time); ok {
-			return lv.Before(rv) || lv.Equal(rv)
-		}
-	}
-	return false
+	cmp, err := compareValues(left, right)
+	return err == nil && cmp <= 0
 }
 
 func evaluateGreaterThan(left, right Value) bool {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv > rv
-		case int:
-			return lv > float64(rv)
+	cmp, err := compareValues(left, right)
+	return err == nil && cmp > 0
+}
+
+func evaluateGreaterThanOrEqual(left, right Value) bool {
+	cmp, err := compareValues(left, right)
+	return err == nil && cmp >= 0
+}
+
+// Membership and range operations
+func evaluateIn(left, right Value) (Value, error) {
+	switch rv := right.(type) {
+	case []Value:
+		for _, elem := range rv {
+			if evaluateEqual(left, elem) {
+				return true, nil
+			}
 		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) > rv
-		case int:
-			return lv > rv
+		return false, nil
+	case map[string]Value:
+		key, ok := left.(string)
+		if !ok {
+			return false, nil
 		}
+		_, found := rv[key]
+		return found, nil
+	case map[Value]Value:
+		key, err := normalizeMapKey(left)
+		if err != nil {
+			return false, nil
+		}
+		_, found := rv[key]
+		return found, nil
 	case string:
-		if rv, ok := right.(string); ok {
-			return lv > rv
+		sub, ok := left.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid operands for in operator: %T in string", left)
 		}
-	case time.Time:
-		if rv, ok := right.(time.Time); ok {
-			return lv.After(rv)
+		return strings.Contains(rv, sub), nil
+	}
+
+	rv := reflect.ValueOf(right)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if evaluateEqual(left, rv.Index(i).Interface()) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		key := reflect.ValueOf(left)
+		if !key.IsValid() || !key.Type().ConvertibleTo(rv.Type().Key()) {
+			return false, nil
 		}
+		return rv.MapIndex(key.Convert(rv.Type().Key())).IsValid(), nil
 	}
-	return false
+
+	return nil, fmt.Errorf("invalid operands for in operator: %T in %T", left, right)
 }
 
-func evaluateGreaterThanOrEqual(left, right Value) bool {
-	switch lv := left.(type) {
-	case float64:
-		switch rv := right.(type) {
-		case float64:
-			return lv >= rv
-		case int:
-			return lv >= float64(rv)
-		}
-	case int:
-		switch rv := right.(type) {
-		case float64:
-			return float64(lv) >= rv
-		case int:
-			return lv >= rv
+func evaluateBetween(value, low, high Value, exclusive bool) (Value, error) {
+	lowCmp, err := compareValues(value, low)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operands for between operator: %w", err)
+	}
+	highCmp, err := compareValues(value, high)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operands for between operator: %w", err)
+	}
+
+	if exclusive {
+		return lowCmp > 0 && highCmp < 0, nil
+	}
+	return lowCmp >= 0 && highCmp <= 0, nil
+}
+
+// compareValues orders two numbers, strings, times or durations, returning
+// -1, 0 or 1.
+func compareValues(left, right Value) (int, error) {
+	if l, ok := normalizeNumber(left); ok {
+		if r, ok := normalizeNumber(right); ok {
+			if cmp, ok := compareNumbers(l, r); ok {
+				return cmp, nil
+			}
+			return 0, fmt.Errorf("cannot compare NaN")
 		}
+	}
+
+	switch lv := left.(type) {
 	case string:
 		if rv, ok := right.(string); ok {
-			return lv >= rv
+			return strings.Compare(lv, rv), nil
 		}
 	case time.Time:
 		if rv, ok := right.(time.Time); ok {
-			return lv.After(rv) || lv.Equal(rv)
+			return lv.Compare(rv), nil
+		}
+	case time.Duration:
+		if rv, ok := right.(time.Duration); ok {
+			return cmpOrdered(int64(lv), int64(rv)), nil
 		}
 	}
-	return false
+
+	return 0, fmt.Errorf("cannot compare %T and %T", left, right)
 }
 
 // Logical operations
@@ -366,15 +605,493 @@ func evaluateNot(expr Value) bool {
 }
 
 func evaluateNegate(expr Value) (Value, error) {
-	switch v := expr.(type) {
-	case float64:
+	n, _ := normalizeNumber(expr)
+	switch v := n.(type) {
+	case int64:
+		if v == math.MinInt64 {
+			return nil, fmt.Errorf("integer overflow: -(%d)", v)
+		}
 		return -v, nil
-	case int:
+	case float64:
 		return -v, nil
 	}
+	if dur, ok := expr.(time.Duration); ok {
+		return -dur, nil
+	}
 	return nil, fmt.Errorf("cannot negate %T", expr)
 }
 
+// Bitwise operations
+
+// evaluateBitwise applies &, |, xor, << or >> to integer operands. Both
+// operands of &, | and xor must be ints or both uints; the shift count may
+// be either, but must not be negative. Shifting by 64 or more bits gives 0,
+// or -1 for a right shift of a negative int.
+func evaluateBitwise(op string, left, right Value) (Value, error) {
+	l, lok := normalizeNumber(left)
+	r, rok := normalizeNumber(right)
+	if !lok || !rok || isDouble(l) || isDouble(r) {
+		return nil, fmt.Errorf("%s requires integer operands, got %T and %T", op, left, right)
+	}
+
+	if op == "<<" || op == ">>" {
+		var count uint64
+		switch n := r.(type) {
+		case int64:
+			if n < 0 {
+				return nil, fmt.Errorf("negative shift count: %d", n)
+			}
+			count = uint64(n)
+		case uint64:
+			count = n
+		}
+		switch v := l.(type) {
+		case int64:
+			if op == "<<" {
+				return v << count, nil
+			}
+			return v >> count, nil
+		case uint64:
+			if op == "<<" {
+				return v << count, nil
+			}
+			return v >> count, nil
+		}
+	}
+
+	switch lv := l.(type) {
+	case int64:
+		if rv, ok := r.(int64); ok {
+			return intBitwise(op, lv, rv), nil
+		}
+	case uint64:
+		if rv, ok := r.(uint64); ok {
+			return uintBitwise(op, lv, rv), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operands for %s: int and uint cannot be mixed (%v %s %v)", op, left, op, right)
+}
+
+func intBitwise(op string, a, b int64) int64 {
+	switch op {
+	case "&":
+		return a & b
+	case "|":
+		return a | b
+	}
+	return a ^ b
+}
+
+func uintBitwise(op string, a, b uint64) uint64 {
+	switch op {
+	case "&":
+		return a & b
+	case "|":
+		return a | b
+	}
+	return a ^ b
+}
+
+func isDouble(n Value) bool {
+	_, ok := n.(float64)
+	return ok
+}
+
+func evaluateComplement(expr Value) (Value, error) {
+	n, _ := normalizeNumber(expr)
+	switch v := n.(type) {
+	case int64:
+		return ^v, nil
+	case uint64:
+		return ^v, nil
+	}
+	return nil, fmt.Errorf("~ requires an integer operand, got %T", expr)
+}
+
+// EvalError reports a failure while evaluating an expression. Span is the
+// location of the innermost node that failed and Source is that node's text
+// in the expression; Err is the underlying error.
+type EvalError struct {
+	Span   Span
+	Source string
+	Err    error
+
+	// node is the node that failed, which ?? uses to tell a missing
+	// operand from a missing value further inside it
+	node ASTNode
+}
+
+func (e *EvalError) Error() string {
+	if e.Source == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (at position %d: %s)", e.Err, e.Span.Start, e.Source)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// UndefinedVariableError reports an identifier that is neither a variable in
+// scope nor a function.
+type UndefinedVariableError struct {
+	Name string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("undefined variable: %s", e.Name)
+}
+
+// NoSuchKeyError reports a field or map key that is missing from the value
+// it was selected on. Path describes the full selection, e.g.
+// user.address.city.
+type NoSuchKeyError struct {
+	Path string
+}
+
+func (e *NoSuchKeyError) Error() string {
+	return fmt.Sprintf("no such key: %s", e.Path)
+}
+
+// Field selection
+func selectField(obj Value, field string, path fmt.Stringer) (Value, error) {
+	switch v := obj.(type) {
+	case map[string]Value:
+		if val, ok := v[field]; ok {
+			return val, nil
+		}
+		return nil, &NoSuchKeyError{Path: path.String()}
+	case map[Value]Value:
+		if val, ok := v[field]; ok {
+			return val, nil
+		}
+		return nil, &NoSuchKeyError{Path: path.String()}
+	case nil:
+		return nil, fmt.Errorf("cannot select field %q of null value: %s", field, path)
+	}
+
+	rv := reflect.ValueOf(obj)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("cannot select field %q of null value: %s", field, path)
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		keyType := rv.Type().Key()
+		if keyType.Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot select field %q of map with %s keys", field, keyType)
+		}
+		val := rv.MapIndex(reflect.ValueOf(field).Convert(keyType))
+		if !val.IsValid() {
+			return nil, &NoSuchKeyError{Path: path.String()}
+		}
+		return val.Interface(), nil
+	case reflect.Struct:
+		if val, ok := structField(rv, field); ok {
+			return val.Interface(), nil
+		}
+		return nil, &NoSuchKeyError{Path: path.String()}
+	}
+
+	return nil, fmt.Errorf("cannot select field %q of %T", field, obj)
+}
+
+// structField looks up an exported struct field by its Go name, its json tag
+// name, or case-insensitively by Go name, in that order.
+func structField(rv reflect.Value, name string) (reflect.Value, bool) {
+	rt := rv.Type()
+	if f, ok := rt.FieldByName(name); ok && f.IsExported() {
+		return rv.FieldByIndex(f.Index), true
+	}
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag == name {
+			return rv.Field(i), true
+		}
+	}
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.IsExported() && strings.EqualFold(f.Name, name) {
+			return rv.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// normalizeMapKey checks that key may be used as a map key and converts it
+// to its canonical form. Keys must be strings, booleans, ints or uints;
+// integers of any Go type become int64 or uint64 and integral doubles become
+// int64 so that lookups match regardless of where a number came from.
+func normalizeMapKey(key Value) (Value, error) {
+	switch key.(type) {
+	case string, bool:
+		return key, nil
+	}
+	if n, ok := normalizeNumber(key); ok {
+		if f, isDouble := n.(float64); isDouble {
+			if i, ok := toInt64(f); ok {
+				return i, nil
+			}
+			return nil, fmt.Errorf("unsupported map key: %v", key)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unsupported map key type: %T", key)
+}
+
+// IndexOutOfRangeError reports an index or slice bound outside of a list or
+// string.
+type IndexOutOfRangeError struct {
+	Index  int
+	Length int
+}
+
+func (e *IndexOutOfRangeError) Error() string {
+	return fmt.Sprintf("index out of range: %d with length %d", e.Index, e.Length)
+}
+
+// isMissing reports whether err means that a value is absent rather than
+// invalid: an undefined variable, a missing field or map key, or an index out
+// of range. The ?? operator substitutes its default for these when they come
+// from its operand's own access path.
+func isMissing(err error) bool {
+	var undefined *UndefinedVariableError
+	var noSuchKey *NoSuchKeyError
+	var outOfRange *IndexOutOfRangeError
+	return errors.As(err, &undefined) || errors.As(err, &noSuchKey) || errors.As(err, &outOfRange)
+}
+
+// isNull reports whether v is null or a nil pointer or interface
+func isNull(v Value) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// forEachEntry calls f with each index and element of a list, or each key
+// and value of a map in ascending key order, stopping at the first error
+func forEachEntry(source Value, f func(key, val Value) error) error {
+	switch v := source.(type) {
+	case []Value:
+		for i, item := range v {
+			if err := f(int64(i), item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]Value:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := f(key, v[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(source)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := f(int64(i), rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i].Interface(), keys[j].Interface()
+			if cmp, err := compareValues(a, b); err == nil {
+				return cmp < 0
+			}
+			return fmt.Sprint(a) < fmt.Sprint(b)
+		})
+		for _, key := range keys {
+			if err := f(key.Interface(), rv.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot iterate over %T", source)
+}
+
+// Index and slice operations
+func indexValue(obj Value, index Value, path fmt.Stringer) (Value, error) {
+	switch v := obj.(type) {
+	case []Value:
+		i, err := resolveIndex(index, len(v))
+		if err != nil {
+			return nil, err
+		}
+		return v[i], nil
+	case map[string]Value:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be string, got %T", index)
+		}
+		if val, ok := v[key]; ok {
+			return val, nil
+		}
+		return nil, &NoSuchKeyError{Path: path.String()}
+	case map[Value]Value:
+		key, err := normalizeMapKey(index)
+		if err != nil {
+			return nil, err
+		}
+		if val, ok := v[key]; ok {
+			return val, nil
+		}
+		return nil, &NoSuchKeyError{Path: path.String()}
+	case string:
+		runes := []rune(v)
+		i, err := resolveIndex(index, len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[i]), nil
+	case nil:
+		return nil, fmt.Errorf("cannot index null value: %s", path)
+	}
+
+	rv := reflect.ValueOf(obj)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("cannot index null value: %s", path)
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		i, err := resolveIndex(index, rv.Len())
+		if err != nil {
+			return nil, err
+		}
+		return rv.Index(i).Interface(), nil
+	case reflect.Map:
+		key := reflect.ValueOf(index)
+		if !key.IsValid() || !key.Type().ConvertibleTo(rv.Type().Key()) {
+			return nil, fmt.Errorf("map key must be %s, got %T", rv.Type().Key(), index)
+		}
+		val := rv.MapIndex(key.Convert(rv.Type().Key()))
+		if !val.IsValid() {
+			return nil, &NoSuchKeyError{Path: path.String()}
+		}
+		return val.Interface(), nil
+	}
+
+	return nil, fmt.Errorf("cannot index %T", obj)
+}
+
+func sliceValue(obj Value, start, end Value) (Value, error) {
+	switch v := obj.(type) {
+	case []Value:
+		from, to, err := resolveSliceBounds(start, end, len(v))
+		if err != nil {
+			return nil, err
+		}
+		return v[from:to], nil
+	case string:
+		runes := []rune(v)
+		from, to, err := resolveSliceBounds(start, end, len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[from:to]), nil
+	}
+
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() == reflect.Slice {
+		from, to, err := resolveSliceBounds(start, end, rv.Len())
+		if err != nil {
+			return nil, err
+		}
+		return rv.Slice(from, to).Interface(), nil
+	}
+
+	return nil, fmt.Errorf("cannot slice %T", obj)
+}
+
+// resolveIndex converts an index value to a position within a sequence of
+// the given length. Negative indexes count from the end.
+func resolveIndex(index Value, length int) (int, error) {
+	i, err := toIndex(index)
+	if err != nil {
+		return 0, err
+	}
+	pos := i
+	if pos < 0 {
+		pos += length
+	}
+	if pos < 0 || pos >= length {
+		return 0, &IndexOutOfRangeError{Index: i, Length: length}
+	}
+	return pos, nil
+}
+
+func resolveSliceBounds(start, end Value, length int) (int, int, error) {
+	from, to := 0, length
+	if start != nil {
+		i, err := toIndex(start)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = i
+		if from < 0 {
+			from += length
+		}
+		if from < 0 || from > length {
+			return 0, 0, &IndexOutOfRangeError{Index: i, Length: length}
+		}
+	}
+	if end != nil {
+		i, err := toIndex(end)
+		if err != nil {
+			return 0, 0, err
+		}
+		to = i
+		if to < 0 {
+			to += length
+		}
+		if to < 0 || to > length {
+			return 0, 0, &IndexOutOfRangeError{Index: i, Length: length}
+		}
+	}
+	if from > to {
+		return 0, 0, fmt.Errorf("invalid slice bounds: %d > %d", from, to)
+	}
+	return from, to, nil
+}
+
+func toIndex(v Value) (int, error) {
+	i, ok := toInt64(v)
+	if !ok {
+		return 0, fmt.Errorf("index must be an integer, got %v", v)
+	}
+	return int(i), nil
+}
+
 // Performance monitoring
 type EvaluationStats struct {
 	Evaluations int64
@@ -93,6 +93,107 @@ func stringSplit(ctx context.Context, args ...Value) (Value, error) {
 	return result, nil
 }
 
+// stringFormat formats its arguments according to a format string, e.g.
+// format('%.2f', amount). Verbs take the flags, width and precision of Go's
+// fmt package, but only this subset is accepted, and each verb is checked
+// against its argument:
+//
+//	%s %v  any value
+//	%d     int or uint
+//	%f %e %g  any number
+//	%x %X  int, uint, string or bytes
+//	%o %b  int or uint
+//	%q     string
+//	%t     bool
+//	%%     a literal percent sign
+func stringFormat(ctx context.Context, args ...Value) (Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("format() requires at least 1 argument")
+	}
+
+	format, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("format() first argument must be a string")
+	}
+
+	values := append([]Value(nil), args[1:]...)
+	used := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			return nil, fmt.Errorf("format() verb %q is incomplete", format[start:])
+		}
+		verb := format[i]
+		if verb == '%' {
+			if i != start+1 {
+				return nil, fmt.Errorf("format() verb %q takes no flags", format[start:i+1])
+			}
+			continue
+		}
+		if used == len(values) {
+			return nil, fmt.Errorf("format() verb %q has no argument", format[start:i+1])
+		}
+		arg, err := formatArgument(verb, values[used])
+		if err != nil {
+			return nil, fmt.Errorf("format() verb %q: %w", format[start:i+1], err)
+		}
+		values[used] = arg
+		used++
+	}
+	if used != len(values) {
+		return nil, fmt.Errorf("format() has %d arguments but %d verbs", len(values), used)
+	}
+
+	return fmt.Sprintf(format, values...), nil
+}
+
+// formatArgument checks that verb can format val, returning val converted
+// to the form fmt expects, such as a float64 for an integer given to %f
+func formatArgument(verb byte, val Value) (Value, error) {
+	n, isNumber := normalizeNumber(val)
+	switch verb {
+	case 's', 'v':
+		return val, nil
+	case 'd', 'o', 'b':
+		if _, isDouble := n.(float64); isNumber && !isDouble {
+			return n, nil
+		}
+		return nil, fmt.Errorf("requires an integer, got %T", val)
+	case 'f', 'e', 'g':
+		if isNumber {
+			return toDouble(n), nil
+		}
+		return nil, fmt.Errorf("requires a number, got %T", val)
+	case 'x', 'X':
+		switch val.(type) {
+		case string, []byte:
+			return val, nil
+		}
+		if _, isDouble := n.(float64); isNumber && !isDouble {
+			return n, nil
+		}
+		return nil, fmt.Errorf("requires an integer, string or bytes, got %T", val)
+	case 'q':
+		if _, ok := val.(string); ok {
+			return val, nil
+		}
+		return nil, fmt.Errorf("requires a string, got %T", val)
+	case 't':
+		if _, ok := val.(bool); ok {
+			return val, nil
+		}
+		return nil, fmt.Errorf("requires a bool, got %T", val)
+	}
+	return nil, fmt.Errorf("unsupported verb")
+}
+
 func stringMatches(ctx context.Context, args ...Value) (Value, error) {
 	if len(args) != 2 {
 		return nil, fmt.Errorf("matches() requires 2 arguments")
@@ -175,14 +276,20 @@ func mathAbs(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("abs() requires 1 argument")
 	}
 
-	switch v := args[0].(type) {
+	n, _ := normalizeNumber(args[0])
+	switch v := n.(type) {
 	case float64:
 		return math.Abs(v), nil
-	case int:
+	case int64:
+		if v == math.MinInt64 {
+			return nil, fmt.Errorf("abs() integer overflow: %d", v)
+		}
 		if v < 0 {
 			return -v, nil
 		}
 		return v, nil
+	case uint64:
+		return v, nil
 	default:
 		return nil, fmt.Errorf("abs() requires numeric argument")
 	}
@@ -193,9 +300,9 @@ func mathCeil(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("ceil() requires 1 argument")
 	}
 
-	f, ok := args[0].(float64)
+	f, ok := toFloat(args[0])
 	if !ok {
-		return nil, fmt.Errorf("ceil() requires float64 argument")
+		return nil, fmt.Errorf("ceil() requires numeric argument")
 	}
 
 	return math.Ceil(f), nil
@@ -206,9 +313,9 @@ func mathFloor(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("floor() requires 1 argument")
 	}
 
-	f, ok := args[0].(float64)
+	f, ok := toFloat(args[0])
 	if !ok {
-		return nil, fmt.Errorf("floor() requires float64 argument")
+		return nil, fmt.Errorf("floor() requires numeric argument")
 	}
 
 	return math.Floor(f), nil
@@ -219,9 +326,9 @@ func mathRound(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("round() requires 1 argument")
 	}
 
-	f, ok := args[0].(float64)
+	f, ok := toFloat(args[0])
 	if !ok {
-		return nil, fmt.Errorf("round() requires float64 argument")
+		return nil, fmt.Errorf("round() requires numeric argument")
 	}
 
 	return math.Round(f), nil
@@ -232,9 +339,9 @@ func mathSqrt(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("sqrt() requires 1 argument")
 	}
 
-	f, ok := args[0].(float64)
+	f, ok := toFloat(args[0])
 	if !ok {
-		return nil, fmt.Errorf("sqrt() requires float64 argument")
+		return nil, fmt.Errorf("sqrt() requires numeric argument")
 	}
 
 	return math.Sqrt(f), nil
@@ -245,19 +352,29 @@ func mathPow(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("pow() requires 2 arguments")
 	}
 
-	base, ok := args[0].(float64)
+	base, ok := toFloat(args[0])
 	if !ok {
-		return nil, fmt.Errorf("pow() first argument must be float64")
+		return nil, fmt.Errorf("pow() first argument must be numeric")
 	}
 
-	exp, ok := args[1].(float64)
+	exp, ok := toFloat(args[1])
 	if !ok {
-		return nil, fmt.Errorf("pow() second argument must be float64")
+		return nil, fmt.Errorf("pow() second argument must be numeric")
 	}
 
 	return math.Pow(base, exp), nil
 }
 
+// mathXor returns the bitwise exclusive or of two ints or two uints. It is
+// a function because ^ is the power operator.
+func mathXor(ctx context.Context, args ...Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("xor() requires 2 arguments")
+	}
+
+	return evaluateBitwise("xor()", args[0], args[1])
+}
+
 func mathMin(ctx context.Context, args ...Value) (Value, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("min() requires at least 1 argument")
@@ -299,16 +416,23 @@ func collectionSum(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("sum() requires array argument")
 	}
 
-	var sum float64
-	for _, v := range values {
-		switch n := v.(type) {
-		case float64:
-			sum += n
-		case int:
-			sum += float64(n)
-		default:
+	// The sum keeps the element type: ints sum to an int, uints to a uint,
+	// and any double makes the result a double
+	var sum Value = int64(0)
+	for i, v := range values {
+		n, ok := normalizeNumber(v)
+		if !ok {
 			return nil, fmt.Errorf("sum() requires numeric values")
 		}
+		if i == 0 {
+			sum = n
+			continue
+		}
+		result, _, err := evaluateArithmetic("+", sum, n)
+		if err != nil {
+			return nil, fmt.Errorf("sum(): %w", err)
+		}
+		sum = result
 	}
 
 	return sum, nil
@@ -333,7 +457,7 @@ func collectionAvg(ctx context.Context, args ...Value) (Value, error) {
 		return nil, err
 	}
 
-	return sum.(float64) / float64(len(values)), nil
+	return toDouble(sum) / float64(len(values)), nil
 }
 
 func collectionDistinct(ctx context.Context, args ...Value) (Value, error) {
@@ -419,19 +543,19 @@ func timeDate(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("date() requires 3 arguments")
 	}
 
-	year, ok := args[0].(float64)
+	year, ok := toInt64(args[0])
 	if !ok {
-		return nil, fmt.Errorf("date() first argument must be number")
+		return nil, fmt.Errorf("date() first argument must be integer")
 	}
 
-	month, ok := args[1].(float64)
+	month, ok := toInt64(args[1])
 	if !ok {
-		return nil, fmt.Errorf("date() second argument must be number")
+		return nil, fmt.Errorf("date() second argument must be integer")
 	}
 
-	day, ok := args[2].(float64)
+	day, ok := toInt64(args[2])
 	if !ok {
-		return nil, fmt.Errorf("date() third argument must be number")
+		return nil, fmt.Errorf("date() third argument must be integer")
 	}
 
 	return time.Date(int(year), time.Month(int(month)), int(day), 0, 0, 0, 0, time.UTC), nil
@@ -524,31 +648,86 @@ func typeInt(ctx context.Context, args ...Value) (Value, error) {
 		return nil, fmt.Errorf("int() requires 1 argument")
 	}
 
-	switch v := args[0].(type) {
+	n, _ := normalizeNumber(args[0])
+	switch v := n.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("int() overflow: %d", v)
+		}
+		return int64(v), nil
 	case float64:
-		return int(v), nil
+		// Doubles are truncated towards zero
+		if math.IsNaN(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return nil, fmt.Errorf("int() overflow: %v", v)
+		}
+		return int64(v), nil
+	}
+
+	switch v := args[0].(type) {
 	case string:
-		i, err := strconv.Atoi(v)
-		return i, err
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("int() cannot convert %q", v)
+		}
+		return i, nil
+	case time.Time:
+		return v.Unix(), nil
 	default:
 		return nil, fmt.Errorf("int() requires convertible argument")
 	}
 }
 
+func typeUint(ctx context.Context, args ...Value) (Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("uint() requires 1 argument")
+	}
+
+	n, _ := normalizeNumber(args[0])
+	switch v := n.(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		if v < 0 {
+			return nil, fmt.Errorf("uint() overflow: %d", v)
+		}
+		return uint64(v), nil
+	case float64:
+		// Doubles are truncated towards zero
+		if math.IsNaN(v) || v <= -1 || v >= math.MaxUint64 {
+			return nil, fmt.Errorf("uint() overflow: %v", v)
+		}
+		return uint64(v), nil
+	}
+
+	if v, ok := args[0].(string); ok {
+		u, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("uint() cannot convert %q", v)
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("uint() requires convertible argument")
+}
+
 func typeDouble(ctx context.Context, args ...Value) (Value, error) {
 	if len(args) != 1 {
 		return nil, fmt.Errorf("double() requires 1 argument")
 	}
 
-	switch v := args[0].(type) {
-	case int:
-		return float64(v), nil
-	case string:
+	if f, ok := toFloat(args[0]); ok {
+		return f, nil
+	}
+
+	if v, ok := args[0].(string); ok {
 		f, err := strconv.ParseFloat(v, 64)
-		return f, err
-	default:
-		return nil, fmt.Errorf("double() requires convertible argument")
+		if err != nil {
+			return nil, fmt.Errorf("double() cannot convert %q", v)
+		}
+		return f, nil
 	}
+	return nil, fmt.Errorf("double() requires convertible argument")
 }
 
 func typeString(ctx context.Context, args ...Value) (Value, error) {
@@ -576,8 +755,19 @@ func typeDuration(ctx context.Context, args ...Value) (Value, error) {
 	case string:
 		dur, err := time.ParseDuration(v)
 		return dur, err
+	case time.Duration:
+		return v, nil
+	}
+
+	// Numbers are interpreted as nanoseconds
+	n, _ := normalizeNumber(args[0])
+	switch v := n.(type) {
+	case int64:
+		return time.Duration(v), nil
+	case uint64:
+		return time.Duration(v), nil
 	case float64:
-		return time.Duration(v) * time.Nanosecond, nil
+		return time.Duration(v), nil
 	default:
 		return nil, fmt.Errorf("duration() requires string or numeric argument")
 	}
@@ -608,70 +798,61 @@ func typeOptional(ctx context.Context, args ...Value) (Value, error) {
 
 // Helper functions
 func isLessThan(a, b Value) bool {
-	switch av := a.(type) {
-	case float64:
-		if bv, ok := b.(float64); ok {
-			return av < bv
-		}
-	case int:
-		if bv, ok := b.(int); ok {
-			return av < bv
-		}
-	}
-	return false
+	cmp, err := compareValues(a, b)
+	return err == nil && cmp < 0
 }
 
 func isGreaterThan(a, b Value) bool {
-	switch av := a.(type) {
-	case float64:
-		if bv, ok := b.(float64); ok {
-			return av > bv
-		}
-	case int:
-		if bv, ok := b.(int); ok {
-			return av > bv
-		}
-	}
-	return false
+	cmp, err := compareValues(a, b)
+	return err == nil && cmp > 0
 }
 
 // Method implementations
-func callStringMethod(_ *Context, str string, method string, _ []Value) (Value, error) {
+
+// callStringMethod calls a built-in method of strings, reporting ok=false
+// when str has no method of that name
+func callStringMethod(_ *Context, str string, method string, args []Value) (Value, bool, error) {
+	var result Value
 	switch method {
 	case "upper":
-		return strings.ToUpper(str), nil
+		result = strings.ToUpper(str)
 	case "lower":
-		return strings.ToLower(str), nil
+		result = strings.ToLower(str)
 	case "trim":
-		return strings.TrimSpace(str), nil
-	case "length":
-		return float64(len(str)), nil
-	case "size":
-		return float64(len(str)), nil
+		result = strings.TrimSpace(str)
+	case "length", "size":
+		result = int64(len(str))
 	default:
-		return nil, fmt.Errorf("string method %s not found", method)
+		return nil, false, nil
+	}
+	if len(args) != 0 {
+		return nil, true, fmt.Errorf("string method %s takes no arguments, got %d", method, len(args))
 	}
+	return result, true, nil
 }
 
-func callArrayMethod(_ *Context, arr []Value, method string, _ []Value) (Value, error) {
+// callArrayMethod calls a built-in method of lists, reporting ok=false when
+// arr has no method of that name
+func callArrayMethod(_ *Context, arr []Value, method string, args []Value) (Value, bool, error) {
+	var result Value
 	switch method {
-	case "size":
-		return float64(len(arr)), nil
-	case "length":
-		return float64(len(arr)), nil
+	case "size", "length":
+		result = int64(len(arr))
 	case "first":
-		if len(arr) == 0 {
-			return nil, nil
+		if len(arr) > 0 {
+			result = arr[0]
 		}
-		return arr[0], nil
 	case "last":
-		if len(arr) == 0 {
-			return nil, nil
+		if len(arr) > 0 {
+			result = arr[len(arr)-1]
 		}
-		return arr[len(arr)-1], nil
 	default:
-		return nil, fmt.Errorf("array method %s not found", method)
+		return nil, false, nil
+	}
+	if len(args) != 0 {
+		return nil, true, fmt.Errorf("array method %s takes no arguments, got %d", method, len(args))
 	}
+	return result, true, nil
 }
 
 // Collection operation functions (for FunctionCall evaluation)
@@ -682,11 +863,15 @@ func collectionSize(ctx context.Context, args ...Value) (Value, error) {
 
 	switch v := args[0].(type) {
 	case []Value:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
 	case string:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
 	case map[string]Value:
-		return float64(len(v)), nil
+		return int64(len(v)), nil
+	case map[Value]Value:
+		return int64(len(v)), nil
+	case []byte:
+		return int64(len(v)), nil
 	default:
 		return nil, fmt.Errorf("size() requires array, string, or map, got %T", args[0])
 	}
@@ -868,12 +1053,18 @@ func isTruthy(v Value) bool {
 		return val != 0
 	case int:
 		return val != 0
+	case int64:
+		return val != 0
+	case uint64:
+		return val != 0
 	case string:
 		return len(val) > 0
 	case []Value:
 		return len(val) > 0
 	case map[string]Value:
 		return len(val) > 0
+	case map[Value]Value:
+		return len(val) > 0
 	case nil:
 		return false
 	default:
@@ -1,34 +1,90 @@
 package cel
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-// Tokenize the expression into tokens
-func (p *Parser) tokenize() ([]Token, error) {
+// Tokenize splits an expression into tokens, including the comment and
+// whitespace trivia that the parser skips, so that tools can rebuild the
+// source text exactly. The last token is always TokenEOF. Lexical errors are
+// returned as ParseErrors together with the tokens of the rest of the input.
+func Tokenize(expr string) ([]Token, error) {
+	p := NewParser(expr)
+	tokens := p.scan(0, true)
+	if len(p.errors) > 0 {
+		for _, err := range p.errors {
+			err.locate(p.expr)
+		}
+		return tokens, p.errors
+	}
+	return tokens, nil
+}
+
+// scan tokenizes the expression from offset start, keeping comment and
+// whitespace tokens if trivia is set. Lexical errors are recorded and the
+// offending input skipped so that the parser can report further errors.
+func (p *Parser) scan(start int, trivia bool) []Token {
 	var tokens []Token
-	i := 0
+	i := start
 
 	for i < len(p.expr) {
 		char := p.expr[i]
 
-		// Skip whitespace
-		if unicode.IsSpace(rune(char)) {
-			i++
+		r, size := utf8.DecodeRuneInString(p.expr[i:])
+
+		// Whitespace
+		if unicode.IsSpace(r) {
+			start := i
+			for i < len(p.expr) {
+				r, size := utf8.DecodeRuneInString(p.expr[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+			if trivia {
+				tokens = append(tokens, Token{Type: TokenWhitespace, Value: p.expr[start:i], Pos: start, End: i})
+			}
+			continue
+		}
+
+		// Line and block comments
+		if strings.HasPrefix(p.expr[i:], "//") || strings.HasPrefix(p.expr[i:], "/*") {
+			end := p.commentEnd(i)
+			if trivia {
+				tokens = append(tokens, Token{Type: TokenComment, Value: p.expr[i:end], Pos: i, End: end})
+			}
+			i = end
 			continue
 		}
 
-		// String literals
-		if char == '"' || char == '\'' {
-			token, err := p.parseStringLiteral(i)
+		// Interpolated f-strings
+		if p.isTemplateStart(i) {
+			token, end, _, err := p.scanTemplate(i)
 			if err != nil {
-				return nil, err
+				p.addError(err)
+			}
+			token.End = end
+			tokens = append(tokens, token)
+			i = end
+			continue
+		}
+
+		// String and bytes literals
+		if char == '"' || char == '\'' || p.isStringPrefix(i) {
+			token, end, err := p.parseStringLiteral(i)
+			if err != nil {
+				p.addError(err)
 			}
+			token.End = end
 			tokens = append(tokens, token)
-			i = token.Pos + len(token.Value) + 2 // Account for opening and closing quotes
+			i = end
 			continue
 		}
 
@@ -36,80 +92,371 @@ func (p *Parser) tokenize() ([]Token, error) {
 		if isDigit(char) || (char == '.' && i+1 < len(p.expr) && isDigit(p.expr[i+1])) {
 			token, err := p.parseNumberLiteral(i)
 			if err != nil {
-				return nil, err
+				p.addError(err)
 			}
-			tokens = append(tokens, token)
 			i = token.Pos + len(token.Value)
+			token.End = i
+			tokens = append(tokens, token)
 			continue
 		}
 
 		// Identifiers and keywords
-		if isLetter(char) || char == '_' {
+		if isIdentifierStart(r) {
 			token, err := p.parseIdentifier(i)
 			if err != nil {
-				return nil, err
+				p.addError(err)
 			}
-			tokens = append(tokens, token)
 			i = token.Pos + len(token.Value)
+			token.End = i
+			tokens = append(tokens, token)
+			continue
+		}
+
+		// Backtick-quoted field names
+		if char == '`' {
+			token, end, err := p.parseQuotedIdentifier(i)
+			if err != nil {
+				p.addError(err)
+			}
+			token.End = end
+			tokens = append(tokens, token)
+			i = end
 			continue
 		}
 
 		// Operators and punctuation
 		token, advance := p.parseOperatorOrPunctuation(i)
 		if token.Type != TokenEOF {
-			tokens = append(tokens, token)
 			i += advance
+			token.End = i
+			tokens = append(tokens, token)
 			continue
 		}
 
-		return nil, fmt.Errorf("unexpected character: %c", char)
+		p.addError(newParseError(i, "unexpected character %q", r))
+		i += size
 	}
 
-	tokens = append(tokens, Token{Type: TokenEOF, Value: "", Pos: len(p.expr)})
-	return tokens, nil
+	tokens = append(tokens, Token{Type: TokenEOF, Value: "", Pos: len(p.expr), End: len(p.expr)})
+	return tokens
 }
 
-func (p *Parser) parseStringLiteral(pos int) (Token, error) {
-	quote := p.expr[pos]
-	start := pos + 1
+// commentEnd returns the offset just past the comment starting at pos. A
+// line comment runs up to, but not including, the end of the line.
+func (p *Parser) commentEnd(pos int) int {
+	if strings.HasPrefix(p.expr[pos:], "//") {
+		if i := strings.IndexByte(p.expr[pos:], '\n'); i >= 0 {
+			return pos + i
+		}
+		return len(p.expr)
+	}
+
+	if i := strings.Index(p.expr[pos+2:], "*/"); i >= 0 {
+		return pos + 2 + i + 2
+	}
+	p.addError(newParseError(pos, "unterminated comment"))
+	return len(p.expr)
+}
+
+// parseStringLiteral lexes a quoted string or bytes literal starting at pos,
+// including any r/b prefix, and returns the token and the offset just past
+// the closing quote. On error the token and offset are still returned so
+// that lexing can continue. Single- and double-quoted, triple-quoted
+// multi-line and raw forms are supported.
+func (p *Parser) parseStringLiteral(pos int) (Token, int, error) {
+	i := pos
+	raw, isBytes := false, false
+	for p.expr[i] != '"' && p.expr[i] != '\'' {
+		switch p.expr[i] {
+		case 'r', 'R':
+			raw = true
+		case 'b', 'B':
+			isBytes = true
+		}
+		i++
+	}
+
+	quote := p.expr[i : i+1]
+	if strings.HasPrefix(p.expr[i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	start := i + len(quote)
+	i = start
+
+	for {
+		if i >= len(p.expr) {
+			token := Token{Type: TokenString, Value: p.expr[start:], Pos: pos}
+			return token, len(p.expr), newParseError(pos, "unterminated string literal")
+		}
+		if strings.HasPrefix(p.expr[i:], quote) {
+			break
+		}
+		switch p.expr[i] {
+		case '\\':
+			if !raw {
+				i++ // Skip escaped character
+			}
+		case '\n', '\r':
+			if len(quote) == 1 {
+				token := Token{Type: TokenString, Value: p.expr[start:i], Pos: pos}
+				return token, i, newParseError(i, "newline in string literal")
+			}
+		}
+		i++
+	}
+
+	value := p.expr[start:i]
+	end := i + len(quote)
+
+	tokenType := TokenString
+	if isBytes {
+		tokenType = TokenBytes
+	}
+
+	if !raw {
+		unescaped, err := unescapeString(value, start, isBytes)
+		if err != nil {
+			return Token{Type: tokenType, Value: value, Pos: pos}, end, err
+		}
+		value = unescaped
+	}
+
+	return Token{Type: tokenType, Value: value, Pos: pos}, end, nil
+}
+
+// isTemplateStart reports whether an f-string starts at pos
+func (p *Parser) isTemplateStart(pos int) bool {
+	return pos+1 < len(p.expr) && (p.expr[pos] == 'f' || p.expr[pos] == 'F') &&
+		(p.expr[pos+1] == '"' || p.expr[pos+1] == '\'')
+}
+
+// scanTemplate lexes an f-string such as f"Hello {name}" starting at pos.
+// It returns the token, whose value is the raw text between the quotes,
+// the offset just past the closing quote and the spans of the placeholder
+// expressions, excluding their braces. In the literal text {{ and }} stand
+// for single braces.
+func (p *Parser) scanTemplate(pos int) (Token, int, []Span, error) {
+	quote := p.expr[pos+1 : pos+2]
+	if strings.HasPrefix(p.expr[pos+1:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	start := pos + 1 + len(quote)
+
+	var holes []Span
+	var firstErr error
 	i := start
+	for {
+		if i >= len(p.expr) {
+			token := Token{Type: TokenTemplate, Value: p.expr[start:], Pos: pos}
+			return token, len(p.expr), holes, newParseError(pos, "unterminated string literal")
+		}
+		if strings.HasPrefix(p.expr[i:], quote) {
+			break
+		}
+		switch {
+		case p.expr[i] == '\\':
+			i += 2
+			continue
+		case (p.expr[i] == '\n' || p.expr[i] == '\r') && len(quote) == 1:
+			token := Token{Type: TokenTemplate, Value: p.expr[start:i], Pos: pos}
+			return token, i, holes, newParseError(i, "newline in string literal")
+		case strings.HasPrefix(p.expr[i:], "{{") || strings.HasPrefix(p.expr[i:], "}}"):
+			i += 2
+			continue
+		case p.expr[i] == '}':
+			if firstErr == nil {
+				firstErr = newParseError(i, "single '}' in f-string, use '}}' for a literal brace")
+			}
+		case p.expr[i] == '{':
+			end, err := p.scanPlaceholder(i + 1)
+			if err != nil {
+				token := Token{Type: TokenTemplate, Value: p.expr[start:end], Pos: pos}
+				return token, end, holes, err
+			}
+			holes = append(holes, Span{Start: i + 1, End: end})
+			i = end
+		}
+		i++
+	}
+
+	token := Token{Type: TokenTemplate, Value: p.expr[start:i], Pos: pos}
+	return token, i + len(quote), holes, firstErr
+}
 
-	for i < len(p.expr) && p.expr[i] != quote {
-		if p.expr[i] == '\\' && i+1 < len(p.expr) {
-			i += 2 // Skip escaped character
+// scanPlaceholder returns the offset of the '}' that closes the f-string
+// placeholder whose expression starts at start. Brackets and string
+// literals inside the expression are skipped, so placeholders may contain
+// map literals and strings with either quote.
+func (p *Parser) scanPlaceholder(start int) (int, error) {
+	depth := 0
+	for i := start; i < len(p.expr); {
+		c := p.expr[i]
+		switch {
+		case p.isTemplateStart(i):
+			_, end, _, err := p.scanTemplate(i)
+			if err != nil {
+				return end, err
+			}
+			i = end
+			continue
+		case c == '"' || c == '\'' || p.isStringPrefix(i):
+			// A quote that does not start a complete string is most likely
+			// the end of the f-string
+			_, end, err := p.parseStringLiteral(i)
+			if err != nil {
+				return end, newParseError(start-1, "unterminated placeholder in f-string")
+			}
+			i = end
 			continue
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == '}':
+			if depth > 0 {
+				depth--
+				break
+			}
+			if strings.TrimSpace(p.expr[start:i]) == "" {
+				return i, newParseError(start-1, "empty placeholder in f-string")
+			}
+			return i, nil
 		}
 		i++
 	}
+	return len(p.expr), newParseError(start-1, "unterminated placeholder in f-string")
+}
 
-	if i >= len(p.expr) {
-		return Token{}, fmt.Errorf("unterminated string literal")
+// isStringPrefix reports whether a string or bytes literal with an r/b
+// prefix starts at pos
+func (p *Parser) isStringPrefix(pos int) bool {
+	for i := pos; i < len(p.expr) && i < pos+3; i++ {
+		switch p.expr[i] {
+		case 'r', 'R', 'b', 'B':
+			continue
+		case '"', '\'':
+			prefix := strings.ToLower(p.expr[pos:i])
+			return prefix != "" && prefix != "rr" && prefix != "bb"
+		}
+		return false
 	}
+	return false
+}
 
-	value := p.expr[start:i]
-	i++ // Skip closing quote
+// unescapeString processes the escape sequences of a string or bytes literal
+// body that starts at offset pos in the expression. In strings, hex and
+// octal escapes denote Unicode code points; in bytes they denote raw byte
+// values and Unicode escapes are not allowed.
+func unescapeString(body string, pos int, isBytes bool) (string, error) {
+	if !strings.Contains(body, "\\") {
+		return body, nil
+	}
 
-	// Process escape sequences
-	value = strings.ReplaceAll(value, "\\n", "\n")
-	value = strings.ReplaceAll(value, "\\t", "\t")
-	value = strings.ReplaceAll(value, "\\\"", "\"")
-	value = strings.ReplaceAll(value, "\\'", "'")
-	value = strings.ReplaceAll(value, "\\\\", "\\")
+	var b strings.Builder
+	b.Grow(len(body))
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
 
-	return Token{Type: TokenString, Value: value, Pos: pos}, nil
+		escPos := pos + i
+		if i+1 >= len(body) {
+			return "", newParseError(escPos, "invalid escape sequence")
+		}
+		i++
+		switch esc := body[i]; esc {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '?', '"', '\'', '`':
+			b.WriteByte(esc)
+		case 'x', 'X', 'u', 'U':
+			digits := 2
+			switch esc {
+			case 'u':
+				digits = 4
+			case 'U':
+				digits = 8
+			}
+			if isBytes && digits > 2 {
+				return "", newParseError(escPos, "unicode escape \\%c not allowed in bytes literal", esc)
+			}
+			if i+digits >= len(body) {
+				return "", newParseError(escPos, "invalid escape sequence \\%s", body[i:])
+			}
+			code, err := strconv.ParseUint(body[i+1:i+1+digits], 16, 32)
+			if err != nil {
+				return "", newParseError(escPos, "invalid escape sequence \\%s", body[i:i+1+digits])
+			}
+			if isBytes {
+				b.WriteByte(byte(code))
+			} else {
+				r := rune(code)
+				if !utf8.ValidRune(r) {
+					return "", newParseError(escPos, "invalid code point in escape sequence \\%s", body[i:i+1+digits])
+				}
+				b.WriteRune(r)
+			}
+			i += digits
+		case '0', '1', '2', '3':
+			if i+2 >= len(body) || !isOctalDigit(body[i+1]) || !isOctalDigit(body[i+2]) {
+				return "", newParseError(escPos, "invalid octal escape sequence")
+			}
+			code := (esc-'0')<<6 | (body[i+1]-'0')<<3 | (body[i+2] - '0')
+			if isBytes {
+				b.WriteByte(code)
+			} else {
+				b.WriteRune(rune(code))
+			}
+			i += 2
+		default:
+			return "", newParseError(escPos, "invalid escape sequence \\%c", esc)
+		}
+	}
+	return b.String(), nil
 }
 
 func (p *Parser) parseNumberLiteral(pos int) (Token, error) {
 	start := pos
 	i := pos
 
+	// Hexadecimal integers
+	if i+1 < len(p.expr) && p.expr[i] == '0' && (p.expr[i+1] == 'x' || p.expr[i+1] == 'X') {
+		i += 2
+		for i < len(p.expr) && (isHexDigit(p.expr[i]) || p.expr[i] == '_') {
+			i++
+		}
+		if i == start+2 {
+			return Token{Type: TokenNumber, Value: p.expr[start:i], Pos: pos}, newParseError(pos, "invalid hex literal")
+		}
+		if i < len(p.expr) && (p.expr[i] == 'u' || p.expr[i] == 'U') {
+			i++
+		}
+		return Token{Type: TokenNumber, Value: p.expr[start:i], Pos: pos}, nil
+	}
+
 	// Parse integer part
 	for i < len(p.expr) && (isDigit(p.expr[i]) || p.expr[i] == '_') {
 		i++
 	}
 
 	// Parse decimal part
-	if i < len(p.expr) && p.expr[i] == '.' {
+	isDouble := false
+	if i+1 < len(p.expr) && p.expr[i] == '.' && isDigit(p.expr[i+1]) {
+		isDouble = true
 		i++
 		for i < len(p.expr) && (isDigit(p.expr[i]) || p.expr[i] == '_') {
 			i++
@@ -118,170 +465,1153 @@ func (p *Parser) parseNumberLiteral(pos int) (Token, error) {
 
 	// Parse exponent
 	if i < len(p.expr) && (p.expr[i] == 'e' || p.expr[i] == 'E') {
+		isDouble = true
 		i++
 		if i < len(p.expr) && (p.expr[i] == '+' || p.expr[i] == '-') {
 			i++
 		}
-		for i < len(p.expr) && isDigit(p.expr[i]) {
-			i++
+		for i < len(p.expr) && isDigit(p.expr[i]) {
+			i++
+		}
+	}
+
+	// Unsigned suffix
+	if !isDouble && i < len(p.expr) && (p.expr[i] == 'u' || p.expr[i] == 'U') {
+		i++
+	}
+
+	value := p.expr[start:i]
+	return Token{Type: TokenNumber, Value: value, Pos: pos}, nil
+}
+
+// parseNumber converts the text of a number token to an int, uint or double
+// literal. Integers are decimal or 0x-prefixed hex with an optional u suffix
+// for uint; anything with a fraction or exponent is a double. negate is set
+// when the literal is the operand of unary minus, so that the most negative
+// int can be written; pos is the offset of the literal for error reporting.
+func parseNumber(text string, pos int, negate bool) (ASTNode, error) {
+	digits := strings.ReplaceAll(text, "_", "")
+	raw := text
+	if negate {
+		raw = "-" + text
+	}
+
+	lower := strings.ToLower(digits)
+	isHex := strings.HasPrefix(lower, "0x")
+	if !isHex && strings.ContainsAny(lower, ".e") {
+		value, err := strconv.ParseFloat(digits, 64)
+		if err != nil {
+			return nil, newParseError(pos, "invalid double literal %s", text)
+		}
+		if negate {
+			value = -value
+		}
+		return &NumberLiteral{Value: value, raw: raw}, nil
+	}
+
+	base := 10
+	if isHex {
+		base = 16
+		digits = digits[2:]
+	}
+
+	if strings.HasSuffix(lower, "u") {
+		if negate {
+			return nil, newParseError(pos, "uint literal cannot be negative: -%s", text)
+		}
+		value, err := strconv.ParseUint(digits[:len(digits)-1], base, 64)
+		if err != nil {
+			return nil, newParseError(pos, "uint literal out of range: %s", text)
+		}
+		return &UintLiteral{Value: value, raw: raw}, nil
+	}
+
+	if negate {
+		digits = "-" + digits
+	}
+	value, err := strconv.ParseInt(digits, base, 64)
+	if err != nil {
+		return nil, newParseError(pos, "int literal out of range: %s", raw)
+	}
+	return &IntLiteral{Value: value, raw: raw}, nil
+}
+
+// parseQuotedIdentifier lexes a backtick-quoted name such as `content-type`
+// starting at pos and returns the token and the offset just past the closing
+// backtick. The name may contain any character except backticks and
+// newlines.
+func (p *Parser) parseQuotedIdentifier(pos int) (Token, int, error) {
+	start := pos + 1
+	i := start
+	for i < len(p.expr) && p.expr[i] != '`' && p.expr[i] != '\n' {
+		i++
+	}
+
+	token := Token{Type: TokenQuotedIdentifier, Value: p.expr[start:i], Pos: pos}
+	if i >= len(p.expr) || p.expr[i] != '`' {
+		return token, i, newParseError(pos, "unterminated quoted identifier")
+	}
+	if i == start {
+		return token, i + 1, newParseError(pos, "empty quoted identifier")
+	}
+	return token, i + 1, nil
+}
+
+func (p *Parser) parseIdentifier(pos int) (Token, error) {
+	start := pos
+	i := pos
+
+	for i < len(p.expr) {
+		r, size := utf8.DecodeRuneInString(p.expr[i:])
+		if !isIdentifierPart(r) {
+			break
+		}
+		i += size
+	}
+
+	value := p.expr[start:i]
+
+	// Check if it's a keyword
+	keywords := map[string]bool{
+		"true":    true,
+		"false":   true,
+		"null":    true,
+		"in":      true,
+		"between": true,
+		"filter":  true,
+		"map":     true,
+		"all":     true,
+		"exists":  true,
+		"find":    true,
+		"size":    true,
+		"length":  true,
+		"first":   true,
+		"last":    true,
+	}
+
+	tokenType := TokenIdentifier
+	if keywords[value] {
+		tokenType = TokenKeyword
+	}
+
+	return Token{Type: tokenType, Value: value, Pos: pos}, nil
+}
+
+func (p *Parser) parseOperatorOrPunctuation(pos int) (Token, int) {
+	char := p.expr[pos]
+
+	// Multi-character operators
+	if strings.HasPrefix(p.expr[pos:], "...") {
+		return Token{Type: TokenPunctuation, Value: "...", Pos: pos}, 3
+	}
+	if pos+1 < len(p.expr) {
+		twoChar := p.expr[pos : pos+2]
+		switch twoChar {
+		case "==", "!=", "<=", ">=", "&&", "||", "??", "<<", ">>", "|>":
+			return Token{Type: TokenOperator, Value: twoChar, Pos: pos}, 2
+		case "=>":
+			return Token{Type: TokenPunctuation, Value: twoChar, Pos: pos}, 2
+		case "?.":
+			// In a ? .5 : 1 the dot starts a number, not a safe navigation
+			if pos+2 >= len(p.expr) || !isDigit(p.expr[pos+2]) {
+				return Token{Type: TokenPunctuation, Value: twoChar, Pos: pos}, 2
+			}
+		}
+	}
+
+	// Single character operators and punctuation
+	switch char {
+	case '+', '-', '*', '/', '%', '^', '<', '>', '!', '&', '|', '~':
+		return Token{Type: TokenOperator, Value: string(char), Pos: pos}, 1
+	case '(', ')', '[', ']', '{', '}', ',', ':', '?', ';', '.', '=':
+		return Token{Type: TokenPunctuation, Value: string(char), Pos: pos}, 1
+	}
+
+	return Token{Type: TokenEOF, Value: "", Pos: pos}, 1
+}
+
+// Parse expression with operator precedence
+func (p *Parser) parseExpression(precedence int) (ASTNode, error) {
+	start, startPos := p.pos, p.peekToken().Pos
+	left, err := p.parseUnary()
+	if err != nil {
+		// Resume at the next operator so that errors in the remaining
+		// operands are reported as well
+		p.skipTo(true, ",", ";", ":", "?")
+		left = p.badExpr(err, start)
+	}
+
+	for {
+		p.finish(left, startPos)
+		op, ok := p.peekOperator()
+		if !ok {
+			break
+		}
+
+		opPrec := getOperatorPrecedence(op)
+		if opPrec < precedence {
+			break
+		}
+
+		p.nextToken() // consume operator
+
+		if op == "between" {
+			left, err = p.parseBetween(left, opPrec)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if op == "|>" {
+			left, err = p.parsePipe(left)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		right, err := p.parseExpression(opPrec + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &BinaryOp{Op: op, Left: left, Right: right}
+	}
+
+	// The conditional operator binds loosest of all and is right-associative,
+	// so it is only recognised when parsing a complete expression.
+	if precedence == 0 && p.peekPunctuation("?") {
+		ternary, err := p.parseTernary(left)
+		if err != nil {
+			return nil, err
+		}
+		return p.finish(ternary, startPos), nil
+	}
+
+	return left, nil
+}
+
+// parseBetween parses the remainder of x between low and high after the
+// between keyword. The range is inclusive unless followed by the exclusive
+// modifier; an explicit inclusive modifier is also accepted.
+func (p *Parser) parseBetween(expr ASTNode, precedence int) (ASTNode, error) {
+	low, err := p.parseExpression(precedence + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := p.peekToken(); token.Type != TokenIdentifier || token.Value != "and" {
+		return nil, p.unexpected("'and'")
+	}
+	p.nextToken() // consume 'and'
+
+	high, err := p.parseExpression(precedence + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusive := false
+	if token := p.peekToken(); token.Type == TokenIdentifier {
+		switch token.Value {
+		case "exclusive":
+			exclusive = true
+			p.nextToken()
+		case "inclusive":
+			p.nextToken()
+		}
+	}
+
+	return &Between{Expr: expr, Low: low, High: high, Exclusive: exclusive}, nil
+}
+
+// parseTernary parses the remainder of cond ? then : else after the
+// condition.
+func (p *Parser) parseTernary(cond ASTNode) (ASTNode, error) {
+	p.nextToken() // consume '?'
+
+	then, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	els, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ternary{Cond: cond, Then: then, Else: els}, nil
+}
+
+func (p *Parser) parseUnary() (ASTNode, error) {
+	// Handle unary operators
+	if op, ok := p.peekOperator(); ok && (op == "-" || op == "!" || op == "~") {
+		opToken := p.nextToken() // consume operator
+
+		// Fold negative number literals so that -9223372036854775808 is a
+		// valid int rather than an overflowing negation. A literal with a
+		// postfix operation is not folded, so -5.abs() is -(5.abs()) just
+		// as -x.abs() is -(x.abs()).
+		if op == "-" && p.peekToken().Type == TokenNumber && !p.isPostfixAt(p.pos+1) {
+			literal, err := parseNumber(p.nextToken().Value, opToken.Pos, true)
+			if err != nil {
+				return nil, err
+			}
+			return p.finish(literal, opToken.Pos), nil
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return p.finish(&UnaryOp{Op: op, Expr: operand}, opToken.Pos), nil
+	}
+
+	return p.parsePostfix()
+}
+
+// isPostfixAt reports whether the token at index i continues an operand
+// with a member selection, call or index
+func (p *Parser) isPostfixAt(i int) bool {
+	if i >= len(p.tokens) || p.tokens[i].Type != TokenPunctuation {
+		return false
+	}
+	switch p.tokens[i].Value {
+	case ".", "?.", "[", "(":
+		return true
+	}
+	return false
+}
+
+// parsePostfix parses a primary expression followed by any number of
+// member selections such as order.customer.address.city or the null-safe
+// order?.customer, method calls such as name.upper(), index operations such
+// as items[0] and slices such as name[0:3].
+func (p *Parser) parsePostfix() (ASTNode, error) {
+	start := p.peekToken().Pos
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.finish(expr, start)
+		switch {
+		case p.peekPunctuation(".") || p.peekPunctuation("?."):
+			optional := p.nextToken().Value == "?."
+			switch p.peekToken().Type {
+			case TokenIdentifier, TokenKeyword, TokenQuotedIdentifier:
+			default:
+				return nil, p.unexpected("field name")
+			}
+			field := p.nextToken()
+
+			if !p.peekPunctuation("(") || field.Type == TokenQuotedIdentifier {
+				expr = &Select{Operand: expr, Field: field.Value, Optional: optional}
+				continue
+			}
+			p.nextToken() // consume '('
+
+			if optional && isMacro(field.Value) {
+				return nil, newParseError(field.Pos, "safe navigation is not supported for %s()", field.Value)
+			}
+
+			if ident, ok := expr.(*Identifier); ok && ident.Name == "cel" && field.Value == "bind" {
+				expr, err = p.parseBind()
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if isMacro(field.Value) {
+				expr, err = p.parseReceiverMacro(expr, field.Value)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			args, err := p.parseArgumentList()
+			if err != nil {
+				return nil, err
+			}
+			expr = &MethodCall{Object: expr, Method: field.Value, Arguments: args, Optional: optional}
+		case p.peekPunctuation("["):
+			p.nextToken() // consume '['
+			expr, err = p.parseIndexOrSlice(expr)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// parsePipe parses the function call on the right of value |> f(args). The
+// target must be a plain call: neither a bare name such as f nor a method
+// call such as a.f() says where the value goes.
+func (p *Parser) parsePipe(value ASTNode) (ASTNode, error) {
+	name := p.peekToken()
+	if name.Type != TokenIdentifier && name.Type != TokenKeyword {
+		return nil, p.unexpected("function call")
+	}
+	p.nextToken()
+
+	if !p.peekPunctuation("(") {
+		return nil, newParseError(name.Pos, "pipe target must be a function call such as %s()", name.Value)
+	}
+	p.nextToken() // consume '('
+	args, err := p.parseArgumentList()
+	if err != nil {
+		return nil, err
+	}
+
+	call := &FunctionCall{Name: name.Value, Arguments: args}
+	p.finish(call, name.Pos)
+	return &Pipe{Value: value, Call: call}, nil
+}
+
+// parseTemplate parses an f-string. The placeholder expressions are parsed
+// here, once, rather than each time the template is evaluated.
+func (p *Parser) parseTemplate(token Token) (ASTNode, error) {
+	_, end, holes, err := p.scanTemplate(token.Pos)
+	if err != nil {
+		return nil, err
+	}
+	quoteLen := (end - token.Pos - 1 - len(token.Value)) / 2
+	pos := token.Pos + 1 + quoteLen
+
+	template := &Template{}
+	for _, hole := range holes {
+		text, err := templateText(p.expr[pos:hole.Start-1], pos)
+		if err != nil {
+			return nil, err
+		}
+		template.Text = append(template.Text, text)
+		template.Exprs = append(template.Exprs, p.parseEmbedded(hole.Start, hole.End))
+		pos = hole.End + 1
+	}
+
+	text, err := templateText(p.expr[pos:end-quoteLen], pos)
+	if err != nil {
+		return nil, err
+	}
+	template.Text = append(template.Text, text)
+	return template, nil
+}
+
+// templateText unescapes a run of literal f-string text that starts at
+// offset pos, in which {{ and }} stand for single braces
+func templateText(raw string, pos int) (string, error) {
+	var b strings.Builder
+	for raw != "" {
+		i := strings.IndexAny(raw, "{}")
+		if i < 0 {
+			i = len(raw)
+		}
+		text, err := unescapeString(raw[:i], pos, false)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(text)
+		if i < len(raw) {
+			b.WriteByte(raw[i])
+			i += 2
+		}
+		raw, pos = raw[i:], pos+i
+	}
+	return b.String(), nil
+}
+
+// parseEmbedded parses the expression in p.expr[start:end], such as an
+// f-string placeholder, with a separate parser. Spans and errors keep their
+// offsets in the whole expression; the errors are added to p's.
+func (p *Parser) parseEmbedded(start, end int) ASTNode {
+	sub := NewParser(p.expr[:end])
+	sub.functions = p.functions
+	ast := sub.parseFrom(start)
+	for _, err := range sub.errors {
+		p.addError(err)
+	}
+	return ast
+}
+
+// isLetAhead reports whether the identifier let just consumed starts a
+// binding. let is not reserved, so that existing variables and fields named
+// let keep working; it is only a keyword when followed by a name and =.
+func (p *Parser) isLetAhead() bool {
+	if p.peekToken().Type != TokenIdentifier || p.pos+1 >= len(p.tokens) {
+		return false
+	}
+	next := p.tokens[p.pos+1]
+	return next.Type == TokenPunctuation && next.Value == "="
+}
+
+// parseLet parses let name = value; body after the let keyword. The body
+// extends as far to the right as possible.
+func (p *Parser) parseLet() (ASTNode, error) {
+	if p.peekToken().Type != TokenIdentifier {
+		return nil, p.unexpected("variable name")
+	}
+	name := p.nextToken()
+
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+
+	value, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	p.expectClosing(";")
+
+	body, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Let{Name: name.Value, Value: value, Body: body}, nil
+}
+
+// parseBind parses cel.bind(name, value, body) after the opening
+// parenthesis. It is equivalent to let name = value; body.
+func (p *Parser) parseBind() (ASTNode, error) {
+	pos := p.peekToken().Pos
+	args, err := p.parseArgumentList()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 {
+		return nil, newParseError(pos, "cel.bind() requires 3 arguments")
+	}
+
+	name, ok := args[0].(*Identifier)
+	if !ok {
+		return nil, newParseError(pos, "cel.bind() first argument must be variable name")
+	}
+
+	return &Let{Name: name.Name, Value: args[1], Body: args[2]}, nil
+}
+
+// parseReceiverMacro parses the remainder of source.filter(x, pred) and the
+// other receiver-style collection macros after the opening parenthesis.
+func (p *Parser) parseReceiverMacro(source ASTNode, operation string) (ASTNode, error) {
+	if p.peekToken().Type != TokenIdentifier {
+		return nil, p.unexpected("variable name")
+	}
+	variable := p.nextToken()
+
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	switch operation {
+	case "filter":
+		return &Filter{Variable: variable.Value, Source: source, Predicate: body}, nil
+	case "map":
+		return &Map{Variable: variable.Value, Source: source, Transform: body}, nil
+	case "all":
+		return &All{Variable: variable.Value, Source: source, Predicate: body}, nil
+	case "exists":
+		return &Exists{Variable: variable.Value, Source: source, Predicate: body}, nil
+	case "exists_one":
+		return &ExistsOne{Variable: variable.Value, Source: source, Predicate: body}, nil
+	case "find":
+		return &Find{Variable: variable.Value, Source: source, Predicate: body}, nil
+	default:
+		return nil, newParseError(variable.Pos, "unknown collection operation: %s", operation)
+	}
+}
+
+// parseIndexOrSlice parses the remainder of operand[index] or
+// operand[start:end] after the opening bracket. Either slice bound may be
+// omitted.
+func (p *Parser) parseIndexOrSlice(operand ASTNode) (ASTNode, error) {
+	var start ASTNode
+	if !p.peekPunctuation(":") {
+		index, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		start = index
+	}
+
+	if p.peekPunctuation(":") {
+		p.nextToken() // consume ':'
+		var end ASTNode
+		if !p.peekPunctuation("]") {
+			bound, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+			end = bound
+		}
+
+		p.expectClosing("]")
+		return &Slice{Operand: operand, Start: start, End: end}, nil
+	}
+
+	if !p.peekPunctuation("]") {
+		p.addError(p.unexpected("':'", "']'"))
+		p.skipTo(false, "]")
+	}
+	p.expectClosing("]")
+	return &Index{Operand: operand, Index: start}, nil
+}
+
+func (p *Parser) parsePrimary() (ASTNode, error) {
+	// Leave closing brackets and separators for the enclosing construct so
+	// that it can recover from the missing operand
+	if p.atTerminator() {
+		return nil, p.unexpected("expression")
+	}
+
+	token := p.nextToken()
+
+	switch token.Type {
+	case TokenNumber:
+		return parseNumber(token.Value, token.Pos, false)
+
+	case TokenString:
+		return &StringLiteral{Value: token.Value, raw: p.expr[token.Pos:token.End]}, nil
+
+	case TokenBytes:
+		return &BytesLiteral{Value: []byte(token.Value), raw: p.expr[token.Pos:token.End]}, nil
+
+	case TokenTemplate:
+		return p.parseTemplate(token)
+
+	case TokenKeyword:
+		switch token.Value {
+		case "true":
+			return &BooleanLiteral{Value: true, raw: token.Value}, nil
+		case "false":
+			return &BooleanLiteral{Value: false, raw: token.Value}, nil
+		case "null":
+			return &NullLiteral{Value: nil}, nil
+		default:
+			// For collection operations and other keywords, treat as identifier
+			return p.parseIdentifierOrFunctionCall(token)
+		}
+
+	case TokenQuotedIdentifier:
+		return nil, newParseError(token.Pos, "quoted identifier %s is only allowed as a field name", p.describe(token))
+
+	case TokenIdentifier:
+		if p.peekPunctuation("=>") && !p.inGuard {
+			return p.parseLambda([]Token{token})
+		}
+		if token.Value == "match" && p.isMatchAhead() {
+			return p.parseMatch()
+		}
+		if token.Value == "let" && p.isLetAhead() {
+			return p.parseLet()
+		}
+		return p.parseIdentifierOrFunctionCall(token)
+
+	case TokenPunctuation:
+		switch token.Value {
+		case "[":
+			return p.parseListLiteral()
+		case "{":
+			return p.parseMapLiteral()
+		}
+
+		if token.Value == "(" && !p.inGuard && p.isLambdaAhead() {
+			return p.parseLambdaParams()
+		}
+
+		if token.Value == "(" {
+			expr, err := p.parseExpression(0)
+			if err != nil {
+				return nil, err
+			}
+
+			p.expectClosing(")")
+			return expr, nil
+		}
+
+	}
+
+	return nil, &ParseError{
+		Offset:   token.Pos,
+		Expected: []string{"expression"},
+		Message:  "unexpected " + p.describe(token),
+	}
+}
+
+// parseListLiteral parses the elements of [a, ...b, c] after the opening
+// bracket, or a list comprehension. A trailing comma is allowed.
+func (p *Parser) parseListLiteral() (ASTNode, error) {
+	elements := make([]ASTNode, 0)
+	for !p.peekPunctuation("]") && p.peekToken().Type != TokenEOF {
+		if p.peekPunctuation("...") {
+			elements = append(elements, p.parseSpread("list"))
+		} else {
+			elements = append(elements, p.parseElement(","))
+		}
+		if len(elements) == 1 && p.peekWord("for") && !isSpread(elements[0]) {
+			return p.parseComprehension(elements[0], nil, "]")
+		}
+
+		if p.peekPunctuation(",") {
+			p.nextToken() // consume ','
+			continue
+		}
+		if !p.peekPunctuation("]") {
+			p.addError(p.unexpected("','", "']'"))
+			if !p.skipPast(",") {
+				break
+			}
+		}
+	}
+	p.expectClosing("]")
+
+	return &ArrayLiteral{Elements: elements}, nil
+}
+
+// parseMapLiteral parses the entries of {k: v, ...m} after the opening
+// brace, or a map comprehension. A trailing comma is allowed.
+func (p *Parser) parseMapLiteral() (ASTNode, error) {
+	pairs := make([]MapPair, 0)
+	for !p.peekPunctuation("}") && p.peekToken().Type != TokenEOF {
+		if p.peekPunctuation("...") {
+			pairs = append(pairs, MapPair{Key: p.parseSpread("map")})
+			if p.peekPunctuation(",") {
+				p.nextToken() // consume ','
+				continue
+			}
+			if !p.peekPunctuation("}") {
+				p.addError(p.unexpected("','", "'}'"))
+				if !p.skipPast(",") {
+					break
+				}
+			}
+			continue
+		}
+
+		key := p.parseElement(",", ":")
+
+		var value ASTNode
+		if err := p.expect(":"); err != nil {
+			value = p.recoverElement(err, ",")
+		} else {
+			value = p.parseElement(",")
+		}
+		pairs = append(pairs, MapPair{Key: key, Value: value})
+		if len(pairs) == 1 && p.peekWord("for") {
+			return p.parseComprehension(key, value, "}")
+		}
+
+		if p.peekPunctuation(",") {
+			p.nextToken() // consume ','
+			continue
+		}
+		if !p.peekPunctuation("}") {
+			p.addError(p.unexpected("','", "'}'"))
+			if !p.skipPast(",") {
+				break
+			}
+		}
+	}
+	p.expectClosing("}")
+
+	return &MapLiteral{Pairs: pairs}, nil
+}
+
+// isMatchAhead reports whether the identifier match just consumed starts a
+// match expression rather than naming a variable or function. match is not
+// reserved, so it is only a keyword when followed by a subject and a brace:
+// the tokens are scanned for a { outside any brackets, giving up at
+// anything that cannot be part of a subject, such as a comma, a closing
+// bracket or the for of a comprehension.
+func (p *Parser) isMatchAhead() bool {
+	token := p.peekToken()
+	switch token.Type {
+	case TokenIdentifier, TokenNumber, TokenString, TokenBytes, TokenTemplate:
+	case TokenKeyword:
+		if token.Value == "in" || token.Value == "between" {
+			return false
+		}
+	case TokenOperator:
+		if token.Value != "!" && token.Value != "~" {
+			return false
+		}
+	case TokenPunctuation:
+		if token.Value != "{" && token.Value != "(" && token.Value != "[" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	depth := 0
+	for i := p.pos; i < len(p.tokens); i++ {
+		token := p.tokens[i]
+		if depth == 0 && token.Type == TokenIdentifier && token.Value == "for" {
+			return false
+		}
+		if token.Type != TokenPunctuation {
+			continue
+		}
+		switch token.Value {
+		case "{":
+			if depth == 0 {
+				return true
+			}
+			depth++
+		case "(", "[":
+			depth++
+		case ")", "]", "}":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case ",", ";", ":", "?", "=>", "=":
+			if depth == 0 {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// parseMatch parses match subject { pattern [if guard] => body, ... } after
+// the match keyword. A trailing comma is allowed. The last arm must be a
+// catch-all _ or variable pattern without a guard, so that every value is
+// matched.
+func (p *Parser) parseMatch() (ASTNode, error) {
+	subject, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	// Inside the braces => belongs to these arms, even within the guard of
+	// an enclosing match
+	defer func(inGuard bool) { p.inGuard = inGuard }(p.inGuard)
+	p.inGuard = false
+
+	match := &Match{Subject: subject}
+	for !p.peekPunctuation("}") {
+		arm, err := p.parseMatchArm()
+		if err != nil {
+			return nil, err
+		}
+		match.Arms = append(match.Arms, arm)
+
+		if !p.peekPunctuation(",") {
+			break
+		}
+		p.nextToken() // consume ','
+	}
+	closing := p.peekToken()
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	if len(match.Arms) == 0 {
+		return nil, newParseError(closing.Pos, "match requires at least one arm")
+	}
+	last := match.Arms[len(match.Arms)-1]
+	if !isCatchAll(last) {
+		return nil, newParseError(last.Pattern.Span().Start, "match requires a default arm: the last arm must be _ or a variable without a guard")
+	}
+	return match, nil
+}
+
+func (p *Parser) parseMatchArm() (MatchArm, error) {
+	pattern, err := p.parsePattern()
+	if err != nil {
+		return MatchArm{}, err
+	}
+	if dup := duplicateBinding(pattern, make(map[string]bool)); dup != nil {
+		return MatchArm{}, newParseError(dup.Span().Start, "variable %s is bound more than once in pattern", dup.Name)
+	}
+	arm := MatchArm{Pattern: pattern}
+
+	if p.peekWord("if") {
+		p.nextToken() // consume 'if'
+		inGuard := p.inGuard
+		p.inGuard = true
+		arm.Guard, err = p.parseExpression(0)
+		p.inGuard = inGuard
+		if err != nil {
+			return MatchArm{}, err
+		}
+	}
+
+	if err := p.expect("=>"); err != nil {
+		return MatchArm{}, err
+	}
+	if arm.Body, err = p.parseExpression(0); err != nil {
+		return MatchArm{}, err
+	}
+	return arm, nil
+}
+
+// parsePattern parses a match pattern: _, a variable, a literal, or a list
+// or map of patterns
+func (p *Parser) parsePattern() (Pattern, error) {
+	start := p.peekToken()
+	var pattern Pattern
+
+	switch {
+	case start.Type == TokenIdentifier:
+		p.nextToken()
+		if start.Value == "_" {
+			pattern = &WildcardPattern{}
+		} else {
+			pattern = &BindPattern{Name: start.Value}
+		}
+	case p.peekPunctuation("["):
+		p.nextToken() // consume '['
+		list := &ListPattern{}
+		for !p.peekPunctuation("]") {
+			element, err := p.parsePattern()
+			if err != nil {
+				return nil, err
+			}
+			list.Elements = append(list.Elements, element)
+			if !p.peekPunctuation(",") {
+				break
+			}
+			p.nextToken() // consume ','
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		pattern = list
+	case p.peekPunctuation("{"):
+		p.nextToken() // consume '{'
+		m := &MapPattern{}
+		for !p.peekPunctuation("}") {
+			key, err := p.parsePatternLiteral()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parsePattern()
+			if err != nil {
+				return nil, err
+			}
+			m.Entries = append(m.Entries, MapPatternEntry{Key: key, Pattern: value})
+			if !p.peekPunctuation(",") {
+				break
+			}
+			p.nextToken() // consume ','
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+		pattern = m
+	default:
+		literal, err := p.parsePatternLiteral()
+		if err != nil {
+			return nil, err
+		}
+		pattern = &LiteralPattern{Literal: literal}
+	}
+
+	pattern.(interface{ setSpan(Span) }).setSpan(Span{Start: start.Pos, End: p.tokens[p.pos-1].End})
+	return pattern, nil
+}
+
+// duplicateBinding returns the first variable pattern in pat that binds a
+// name already in seen or bound earlier in pat, or nil if there is none
+func duplicateBinding(pat Pattern, seen map[string]bool) *BindPattern {
+	switch pat := pat.(type) {
+	case *BindPattern:
+		if seen[pat.Name] {
+			return pat
+		}
+		seen[pat.Name] = true
+	case *ListPattern:
+		for _, element := range pat.Elements {
+			if dup := duplicateBinding(element, seen); dup != nil {
+				return dup
+			}
+		}
+	case *MapPattern:
+		for _, entry := range pat.Entries {
+			if dup := duplicateBinding(entry.Pattern, seen); dup != nil {
+				return dup
+			}
 		}
 	}
-
-	value := p.expr[start:i]
-	return Token{Type: TokenNumber, Value: value, Pos: pos}, nil
+	return nil
 }
 
-func (p *Parser) parseIdentifier(pos int) (Token, error) {
-	start := pos
-	i := pos
-
-	for i < len(p.expr) && (isLetter(p.expr[i]) || isDigit(p.expr[i]) || p.expr[i] == '_') {
-		i++
+// parsePatternLiteral parses a literal in a pattern, such as "gold", -1 or
+// null
+func (p *Parser) parsePatternLiteral() (ASTNode, error) {
+	start := p.peekToken()
+	switch start.Type {
+	case TokenNumber, TokenString, TokenBytes, TokenKeyword, TokenOperator:
+		literal, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		switch literal.(type) {
+		case *IntLiteral, *UintLiteral, *NumberLiteral, *StringLiteral, *BytesLiteral, *BooleanLiteral, *NullLiteral:
+			return literal, nil
+		}
+		return nil, newParseError(start.Pos, "invalid pattern %s, expected a literal", Unparse(literal))
 	}
+	return nil, p.unexpected("pattern")
+}
 
-	value := p.expr[start:i]
-
-	// Check if it's a keyword
-	keywords := map[string]bool{
-		"true":    true,
-		"false":   true,
-		"null":    true,
-		"in":      true,
-		"between": true,
-		"filter":  true,
-		"map":     true,
-		"all":     true,
-		"exists":  true,
-		"find":    true,
-		"size":    true,
-		"length":  true,
-		"first":   true,
-		"last":    true,
+// isCatchAll reports whether arm matches every value
+func isCatchAll(arm MatchArm) bool {
+	switch arm.Pattern.(type) {
+	case *WildcardPattern, *BindPattern:
+		return arm.Guard == nil
 	}
+	return false
+}
 
-	tokenType := TokenIdentifier
-	if keywords[value] {
-		tokenType = TokenKeyword
+// parseSpread parses a ...value element of a list or map literal, given as
+// kind. Spreading a value whose type is known not to be kind is an error;
+// null is allowed and inserts nothing.
+func (p *Parser) parseSpread(kind string) ASTNode {
+	start := p.nextToken().Pos // consume '...'
+	value := p.parseElement(",")
+	if t := staticType(value); t != "" && t != kind && t != "null" {
+		p.addError(newParseError(start, "cannot spread %s value into a %s", t, kind))
 	}
+	return p.finish(&Spread{Value: value}, start)
+}
 
-	return Token{Type: tokenType, Value: value, Pos: pos}, nil
+func isSpread(node ASTNode) bool {
+	_, ok := node.(*Spread)
+	return ok
 }
 
-func (p *Parser) parseOperatorOrPunctuation(pos int) (Token, int) {
-	char := p.expr[pos]
+// parseComprehension parses the for x in source [if cond] clause of a list
+// comprehension [key for ...] or map comprehension {key: value for ...},
+// up to and including the closing bracket
+func (p *Parser) parseComprehension(key, value ASTNode, closing string) (ASTNode, error) {
+	p.nextToken() // consume 'for'
 
-	// Multi-character operators
-	if pos+1 < len(p.expr) {
-		twoChar := p.expr[pos : pos+2]
-		switch twoChar {
-		case "==", "!=", "<=", ">=", "&&", "||":
-			return Token{Type: TokenOperator, Value: twoChar, Pos: pos}, 2
+	var variables []string
+	for {
+		if p.peekToken().Type != TokenIdentifier {
+			return nil, p.unexpected("variable name")
 		}
+		variables = append(variables, p.nextToken().Value)
+		if len(variables) == 2 || !p.peekPunctuation(",") {
+			break
+		}
+		p.nextToken() // consume ','
 	}
 
-	// Single character operators and punctuation
-	switch char {
-	case '+', '-', '*', '/', '%', '^', '<', '>', '!':
-		return Token{Type: TokenOperator, Value: string(char), Pos: pos}, 1
-	case '(', ')', '[', ']', '{', '}', ',', ':', '?', ';':
-		return Token{Type: TokenPunctuation, Value: string(char), Pos: pos}, 1
+	if token := p.peekToken(); token.Type != TokenKeyword || token.Value != "in" {
+		return nil, p.unexpected("'in'")
 	}
+	p.nextToken() // consume 'in'
 
-	return Token{Type: TokenEOF, Value: "", Pos: pos}, 1
-}
-
-// Parse expression with operator precedence
-func (p *Parser) parseExpression(precedence int) (ASTNode, error) {
-	left, err := p.parseUnary()
+	source, err := p.parseExpression(0)
 	if err != nil {
 		return nil, err
 	}
 
-	for {
-		op, ok := p.peekOperator()
-		if !ok {
-			break
-		}
-
-		opPrec := getOperatorPrecedence(op)
-		if opPrec < precedence {
-			break
-		}
-
-		p.nextToken() // consume operator
-
-		right, err := p.parseExpression(opPrec + 1)
-		if err != nil {
+	var cond ASTNode
+	if p.peekWord("if") {
+		p.nextToken() // consume 'if'
+		if cond, err = p.parseExpression(0); err != nil {
 			return nil, err
 		}
-
-		left = &BinaryOp{Op: op, Left: left, Right: right}
 	}
 
-	return left, nil
+	if err := p.expect(closing); err != nil {
+		return nil, err
+	}
+	return &Comprehension{Key: key, Value: value, Variables: variables, Source: source, Cond: cond}, nil
 }
 
-func (p *Parser) parseUnary() (ASTNode, error) {
-	// Handle unary operators
-	if op, ok := p.peekOperator(); ok && (op == "-" || op == "!") {
-		p.nextToken() // consume operator
-		operand, err := p.parseUnary()
-		if err != nil {
-			return nil, err
+// isLambdaAhead reports whether the tokens following an opening parenthesis
+// form a lambda parameter list, i.e. () =>, (x) => or (x, y) =>.
+func (p *Parser) isLambdaAhead() bool {
+	i := p.pos
+	expectIdent := true
+	for i < len(p.tokens) {
+		token := p.tokens[i]
+		switch {
+		case token.Type == TokenPunctuation && token.Value == ")":
+			next := i + 1
+			return next < len(p.tokens) && p.tokens[next].Type == TokenPunctuation && p.tokens[next].Value == "=>"
+		case expectIdent && token.Type == TokenIdentifier:
+			expectIdent = false
+		case !expectIdent && token.Type == TokenPunctuation && token.Value == ",":
+			expectIdent = true
+		default:
+			return false
 		}
-		return &UnaryOp{Op: op, Expr: operand}, nil
+		i++
 	}
-
-	return p.parsePrimary()
+	return false
 }
 
-func (p *Parser) parsePrimary() (ASTNode, error) {
-	token := p.nextToken()
-
-	switch token.Type {
-	case TokenNumber:
-		value, err := strconv.ParseFloat(token.Value, 64)
-		if err != nil {
-			return nil, err
+// parseLambdaParams parses (x, y) => body after the opening parenthesis
+func (p *Parser) parseLambdaParams() (ASTNode, error) {
+	params := make([]Token, 0)
+	for !p.peekPunctuation(")") {
+		if p.peekToken().Type != TokenIdentifier {
+			return nil, p.unexpected("parameter name")
 		}
-		return &NumberLiteral{Value: value, raw: token.Value}, nil
-
-	case TokenString:
-		return &StringLiteral{Value: token.Value, raw: token.Value}, nil
-
-	case TokenKeyword:
-		switch token.Value {
-		case "true":
-			return &BooleanLiteral{Value: true, raw: token.Value}, nil
-		case "false":
-			return &BooleanLiteral{Value: false, raw: token.Value}, nil
-		case "null":
-			return &NullLiteral{Value: nil}, nil
-		default:
-			// For collection operations and other keywords, treat as identifier
-			return p.parseIdentifierOrFunctionCall(token)
+		params = append(params, p.nextToken())
+		if p.peekPunctuation(",") {
+			p.nextToken() // consume ','
 		}
+	}
+	p.nextToken() // consume ')'
 
-	case TokenIdentifier:
-		return p.parseIdentifierOrFunctionCall(token)
+	return p.parseLambda(params)
+}
 
-	case TokenPunctuation:
-		if token.Value == "(" {
-			expr, err := p.parseExpression(0)
-			if err != nil {
-				return nil, err
-			}
+// parseLambda parses the '=>' and body of a lambda whose parameters have
+// already been read. The body extends as far to the right as possible.
+func (p *Parser) parseLambda(params []Token) (ASTNode, error) {
+	if err := p.expect("=>"); err != nil {
+		return nil, err
+	}
 
-			if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != ")" {
-				return nil, fmt.Errorf("expected ')'")
-			}
-			p.nextToken() // consume ')'
-			return expr, nil
+	names := make([]string, 0, len(params))
+	seen := make(map[string]bool, len(params))
+	for _, param := range params {
+		if seen[param.Value] {
+			return nil, newParseError(param.Pos, "duplicate lambda parameter: %s", param.Value)
 		}
+		seen[param.Value] = true
+		names = append(names, param.Value)
+	}
 
+	body, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("unexpected token: %v", token)
+	return &Lambda{Params: names, Body: body}, nil
 }
 
 func (p *Parser) parseIdentifierOrFunctionCall(ident Token) (ASTNode, error) {
@@ -297,37 +1627,6 @@ func (p *Parser) parseIdentifierOrFunctionCall(ident Token) (ASTNode, error) {
 		return &FunctionCall{Name: ident.Value, Arguments: args}, nil
 	}
 
-	// Check if it's a method call
-	if p.peekToken().Type == TokenIdentifier && p.peekToken().Value == "." {
-		p.nextToken() // consume identifier
-		nextIdent := p.nextToken()
-
-		if nextIdent.Type != TokenIdentifier {
-			return nil, fmt.Errorf("expected method name")
-		}
-
-		var methodArgs []ASTNode
-		if p.peekToken().Type == TokenPunctuation && p.peekToken().Value == "(" {
-			p.nextToken() // consume '('
-			args, err := p.parseArgumentList()
-			if err != nil {
-				return nil, err
-			}
-			methodArgs = args
-
-			if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != ")" {
-				return nil, fmt.Errorf("expected ')'")
-			}
-			p.nextToken() // consume ')'
-		}
-
-		return &MethodCall{
-			Object:    &Identifier{Name: ident.Value},
-			Method:    nextIdent.Value,
-			Arguments: methodArgs,
-		}, nil
-	}
-
 	// Check for collection operations (filter, map, all, exists, find, size, first, last)
 	collectionOps := map[string]bool{
 		"filter": true, "map": true, "all": true, "exists": true, "find": true,
@@ -343,6 +1642,10 @@ func (p *Parser) parseIdentifierOrFunctionCall(ident Token) (ASTNode, error) {
 func (p *Parser) parseArgumentList() ([]ASTNode, error) {
 	var args []ASTNode
 
+	// Lambdas are allowed as arguments even inside a match guard
+	defer func(inGuard bool) { p.inGuard = inGuard }(p.inGuard)
+	p.inGuard = false
+
 	// Check if we have a closing parenthesis immediately
 
 	if p.peekToken().Type == TokenPunctuation && p.peekToken().Value == ")" {
@@ -350,12 +1653,8 @@ func (p *Parser) parseArgumentList() ([]ASTNode, error) {
 		return args, nil
 	}
 
-	for {
-		arg, err := p.parseExpression(0)
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, arg)
+	for p.peekToken().Type != TokenEOF {
+		args = append(args, p.parseElement(","))
 
 		if p.peekToken().Type == TokenPunctuation && p.peekToken().Value == "," {
 			p.nextToken() // consume ','
@@ -363,22 +1662,24 @@ func (p *Parser) parseArgumentList() ([]ASTNode, error) {
 		}
 
 		if p.peekToken().Type == TokenPunctuation && p.peekToken().Value == ")" {
-			p.nextToken() // consume ')'
 			break
 		}
 
-		return nil, fmt.Errorf("expected ',' or ')'")
+		p.addError(p.unexpected("','", "')'"))
+		if !p.skipPast(",") {
+			break
+		}
 	}
+	p.expectClosing(")")
 
 	return args, nil
 }
 
 func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 	// Parse opening parenthesis
-	if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != "(" {
-		return nil, fmt.Errorf("expected '('")
+	if err := p.expect("("); err != nil {
+		return nil, err
 	}
-	p.nextToken() // consume '('
 
 	// Check for simple operations that take single argument
 	if operation == "size" || operation == "first" || operation == "last" {
@@ -387,10 +1688,9 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 			return nil, err
 		}
 
-		if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != ")" {
-			return nil, fmt.Errorf("expected ')'")
+		if err := p.expect(")"); err != nil {
+			return nil, err
 		}
-		p.nextToken() // consume ')'
 
 		switch operation {
 		case "size":
@@ -404,15 +1704,14 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 
 	// Parse variable name for complex operations
 	if p.peekToken().Type != TokenIdentifier {
-		return nil, fmt.Errorf("expected variable name")
+		return nil, p.unexpected("variable name")
 	}
 	variable := p.nextToken()
 
 	// Parse comma
-	if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != "," {
-		return nil, fmt.Errorf("expected ','")
+	if err := p.expect(","); err != nil {
+		return nil, err
 	}
-	p.nextToken() // consume ','
 
 	// Parse source expression
 	source, err := p.parseExpression(0)
@@ -431,15 +1730,14 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 	}
 
 	// Parse closing parenthesis
-	if p.peekToken().Type != TokenPunctuation || p.peekToken().Value != ")" {
-		return nil, fmt.Errorf("expected ')'")
+	if err := p.expect(")"); err != nil {
+		return nil, err
 	}
-	p.nextToken() // consume ')'
 
 	switch operation {
 	case "filter":
 		if predicate == nil {
-			return nil, fmt.Errorf("filter requires predicate")
+			return nil, newParseError(variable.Pos, "filter requires predicate")
 		}
 		return &Filter{
 			Variable:  variable.Value,
@@ -448,7 +1746,7 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 		}, nil
 	case "map":
 		if predicate == nil {
-			return nil, fmt.Errorf("map requires transform function")
+			return nil, newParseError(variable.Pos, "map requires transform function")
 		}
 		return &Map{
 			Variable:  variable.Value,
@@ -457,7 +1755,7 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 		}, nil
 	case "all":
 		if predicate == nil {
-			return nil, fmt.Errorf("all requires predicate")
+			return nil, newParseError(variable.Pos, "all requires predicate")
 		}
 		return &All{
 			Variable:  variable.Value,
@@ -466,7 +1764,7 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 		}, nil
 	case "exists":
 		if predicate == nil {
-			return nil, fmt.Errorf("exists requires predicate")
+			return nil, newParseError(variable.Pos, "exists requires predicate")
 		}
 		return &Exists{
 			Variable:  variable.Value,
@@ -475,7 +1773,7 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 		}, nil
 	case "find":
 		if predicate == nil {
-			return nil, fmt.Errorf("find requires predicate")
+			return nil, newParseError(variable.Pos, "find requires predicate")
 		}
 		return &Find{
 			Variable:  variable.Value,
@@ -483,7 +1781,244 @@ func (p *Parser) parseCollectionOperation(operation string) (ASTNode, error) {
 			Predicate: predicate,
 		}, nil
 	default:
-		return nil, fmt.Errorf("unknown collection operation: %s", operation)
+		return nil, newParseError(variable.Pos, "unknown collection operation: %s", operation)
+	}
+}
+
+// ParseError describes a syntax error in an expression. Offset is the byte
+// offset of the offending token; Line and Column are 1-based, with Column
+// counted in characters. Expected lists the tokens that would have been
+// accepted in its place, such as ')' or identifier, when that is known.
+// Snippet is the source line with a caret under the error position.
+type ParseError struct {
+	Offset   int
+	Line     int
+	Column   int
+	Expected []string
+	Message  string
+	Snippet  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+func newParseError(offset int, format string, args ...interface{}) *ParseError {
+	return &ParseError{Offset: offset, Message: fmt.Sprintf(format, args...)}
+}
+
+// locate fills in the line, column and snippet of e from the source text
+func (e *ParseError) locate(src string) {
+	offset := min(max(e.Offset, 0), len(src))
+	lineStart := strings.LastIndexByte(src[:offset], '\n') + 1
+	lineEnd := len(src)
+	if i := strings.IndexByte(src[offset:], '\n'); i >= 0 {
+		lineEnd = offset + i
+	}
+
+	line := strings.TrimRight(src[lineStart:lineEnd], "\r")
+	prefix := src[lineStart:offset]
+	e.Line = strings.Count(src[:offset], "\n") + 1
+	e.Column = utf8.RuneCountInString(prefix) + 1
+
+	// Keep tabs so that the caret lines up with the source line
+	var caret strings.Builder
+	for _, r := range prefix {
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+	e.Snippet = line + "\n" + caret.String()
+}
+
+// unexpected returns a ParseError at the next token listing the tokens that
+// would have been accepted instead
+func (p *Parser) unexpected(expected ...string) *ParseError {
+	token := p.peekToken()
+	message := "expected " + expected[0]
+	if n := len(expected); n > 1 {
+		message = "expected " + strings.Join(expected[:n-1], ", ") + " or " + expected[n-1]
+	}
+	return &ParseError{
+		Offset:   token.Pos,
+		Expected: expected,
+		Message:  message + ", found " + p.describe(token),
+	}
+}
+
+// expect consumes the punctuation value or returns a ParseError at the next
+// token
+func (p *Parser) expect(value string) error {
+	if !p.peekPunctuation(value) {
+		return p.unexpected("'" + value + "'")
+	}
+	p.nextToken()
+	return nil
+}
+
+// describe returns the source text of token for use in error messages
+func (p *Parser) describe(token Token) string {
+	if token.Type == TokenEOF {
+		return "end of expression"
+	}
+	return "'" + p.expr[token.Pos:token.End] + "'"
+}
+
+// ParseErrors is the list of syntax errors returned by Parser.Parse, in
+// source order
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// Unwrap exposes the individual errors to errors.Is and errors.As
+func (e ParseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// addError records a syntax error and carries on parsing. Only the first
+// error at a given offset is kept, since the others are usually follow-on
+// errors of the same mistake.
+func (p *Parser) addError(err error) {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		parseErr = newParseError(p.peekToken().Pos, "%v", err)
+	}
+	for _, existing := range p.errors {
+		if existing.Offset == parseErr.Offset {
+			return
+		}
+	}
+	p.errors = append(p.errors, parseErr)
+}
+
+// badExpr records err and returns a BadExpr covering the tokens consumed
+// since the token at index start
+func (p *Parser) badExpr(err error, start int) *BadExpr {
+	p.addError(err)
+	from := p.tokens[min(start, len(p.tokens)-1)].Pos
+	to := from
+	if p.pos > start {
+		to = p.tokens[p.pos-1].End
+	}
+	bad := &BadExpr{From: from, To: to}
+	bad.setSpan(Span{Start: from, End: to})
+	return bad
+}
+
+// finish records the span of node as running from start to the end of the
+// last consumed token, unless it already has one, as is the case for a
+// parenthesized expression
+func (p *Parser) finish(node ASTNode, start int) ASTNode {
+	n, ok := node.(interface {
+		Span() Span
+		setSpan(Span)
+	})
+	if !ok || n.Span() != (Span{}) || p.pos == 0 {
+		return node
+	}
+	n.setSpan(Span{Start: start, End: p.tokens[p.pos-1].End})
+	return node
+}
+
+// skipTo skips tokens up to, but not including, the next of the given
+// punctuation values, a closing bracket that belongs to an enclosing group,
+// or the end of input. Brackets opened along the way are skipped as a
+// whole. If operators is set, binary operators are also stopping points.
+func (p *Parser) skipTo(operators bool, values ...string) {
+	depth := 0
+	for {
+		token := p.peekToken()
+		switch {
+		case token.Type == TokenEOF:
+			return
+		case token.Type == TokenPunctuation && strings.Contains("([{", token.Value):
+			depth++
+		case token.Type == TokenPunctuation && strings.Contains(")]}", token.Value):
+			if depth == 0 {
+				return
+			}
+			depth--
+		case depth > 0:
+		case token.Type == TokenPunctuation && slices.Contains(values, token.Value):
+			return
+		case operators:
+			if op, ok := p.peekOperator(); ok && getOperatorPrecedence(op) > 0 {
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
+// atTerminator reports whether the next token ends the current operand,
+// i.e. it is a closing bracket, a separator or the end of input
+func (p *Parser) atTerminator() bool {
+	token := p.peekToken()
+	if token.Type == TokenEOF {
+		return true
+	}
+	if token.Type != TokenPunctuation {
+		return false
+	}
+	switch token.Value {
+	case ")", "]", "}", ",", ";", ":":
+		return true
+	}
+	return false
+}
+
+// skipPast skips tokens up to and including the next value, reporting
+// whether it was found before a closing bracket or the end of input
+func (p *Parser) skipPast(value string) bool {
+	p.skipTo(false, value)
+	if p.peekPunctuation(value) {
+		p.nextToken()
+		return true
+	}
+	return false
+}
+
+// parseElement parses one element of a bracketed, comma-separated list.
+// On error, parsing resumes at the next of the given separators.
+func (p *Parser) parseElement(separators ...string) ASTNode {
+	start := p.pos
+	elem, err := p.parseExpression(0)
+	if err != nil {
+		p.skipTo(false, separators...)
+		return p.badExpr(err, start)
+	}
+	return elem
+}
+
+// recoverElement records err for a list element that could not be started
+// and skips to the next of the given separators
+func (p *Parser) recoverElement(err error, separators ...string) ASTNode {
+	start := p.pos
+	p.skipTo(false, separators...)
+	return p.badExpr(err, start)
+}
+
+// expectClosing consumes the closing punctuation value. If it is missing,
+// the error is recorded and any tokens before it are skipped.
+func (p *Parser) expectClosing(value string) {
+	if err := p.expect(value); err != nil {
+		p.addError(err)
+		p.skipPast(value)
 	}
 }
 
@@ -504,11 +2039,26 @@ func (p *Parser) nextToken() Token {
 	return Token{Type: TokenEOF, Value: "", Pos: len(p.expr)}
 }
 
+// peekWord reports whether the next token is the identifier value, for
+// words such as if and for that are only keywords in context
+func (p *Parser) peekWord(value string) bool {
+	token := p.peekToken()
+	return token.Type == TokenIdentifier && token.Value == value
+}
+
+func (p *Parser) peekPunctuation(value string) bool {
+	token := p.peekToken()
+	return token.Type == TokenPunctuation && token.Value == value
+}
+
 func (p *Parser) peekOperator() (string, bool) {
 	token := p.peekToken()
 	if token.Type == TokenOperator {
 		return token.Value, true
 	}
+	if token.Type == TokenKeyword && (token.Value == "in" || token.Value == "between") {
+		return token.Value, true
+	}
 	return "", false
 }
 
@@ -517,26 +2067,67 @@ func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
 
-func isLetter(c byte) bool {
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isOctalDigit(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// isIdentifierStart reports whether r can begin an identifier: an underscore
+// or a Unicode letter
+func isIdentifierStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// isIdentifierPart reports whether r can continue an identifier. Besides
+// letters, digits are allowed, and combining marks so that names in
+// scripts such as Devanagari can be written.
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc)
 }
 
+// isIdentifier reports whether name can be written without backticks
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		if !isIdentifierPart(r) || (i == 0 && !isIdentifierStart(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// getOperatorPrecedence returns the binding strength of a binary operator,
+// or 0 if op is not one. As in Python, the bitwise operators bind tighter
+// than comparisons, so flags & 4 != 0 tests a bit. A pipe takes everything
+// above comparisons as its value, so xs |> size() > 0 compares the result.
 func getOperatorPrecedence(op string) int {
 	switch op {
-	case "||":
+	case "??":
 		return 1
-	case "&&":
+	case "||":
 		return 2
-	case "==", "!=":
+	case "&&":
 		return 3
-	case "<", ">", "<=", ">=":
+	case "==", "!=":
 		return 4
-	case "+", "-":
+	case "<", ">", "<=", ">=", "in", "between":
 		return 5
-	case "*", "/", "%":
+	case "|>":
 		return 6
-	case "^":
+	case "|":
 		return 7
+	case "&":
+		return 8
+	case "<<", ">>":
+		return 9
+	case "+", "-":
+		return 10
+	case "*", "/", "%":
+		return 11
+	case "^":
+		return 12
 	default:
 		return 0
 	}
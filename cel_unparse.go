@@ -0,0 +1,486 @@
+package cel
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Precedence of the unary and postfix forms, above every binary operator.
+// Ternaries, let bindings and lambdas have precedence 0: their last operand
+// extends as far to the right as possible, so they need parentheses
+// whenever anything follows them.
+const (
+	unaryPrecedence   = 100
+	postfixPrecedence = 101
+)
+
+// Unparse converts an AST back into expression source. The result parses to
+// an equivalent AST and uses only the parentheses that precedence requires.
+// Literals keep their original spelling when they came from the parser.
+func Unparse(node ASTNode) string {
+	var b strings.Builder
+	unparse(&b, node)
+	return b.String()
+}
+
+// FormatOptions controls how Format lays out an expression
+type FormatOptions struct {
+	// MaxWidth is the line length above which expressions are broken across
+	// lines. Zero means 80.
+	MaxWidth int
+
+	// Indent is the indentation added for each continuation level. Empty
+	// means two spaces.
+	Indent string
+}
+
+// Format unparses node like Unparse, but breaks expressions that do not fit
+// in opts.MaxWidth across lines. Boolean chains get one operand per line
+// with the operator leading, ternaries one branch per line, match
+// expressions one arm per line and let bindings one binding per line. The
+// output parses to the same AST as Unparse.
+func Format(node ASTNode, opts FormatOptions) string {
+	if opts.MaxWidth <= 0 {
+		opts.MaxWidth = 80
+	}
+	if opts.Indent == "" {
+		opts.Indent = "  "
+	}
+	f := &formatter{opts: opts}
+	return f.format(node, 0)
+}
+
+// String returns the canonical source form of the expression
+func (e *Expression) String() string {
+	if e.ast == nil {
+		return ""
+	}
+	return Unparse(e.ast)
+}
+
+// precedenceOf returns the binding strength of node as an operand
+func precedenceOf(node ASTNode) int {
+	switch n := node.(type) {
+	case *BinaryOp:
+		return getOperatorPrecedence(n.Op)
+	case *Between:
+		return getOperatorPrecedence("between")
+	case *Pipe:
+		return getOperatorPrecedence("|>")
+	case *Ternary, *Let, *Lambda:
+		return 0
+	case *UnaryOp:
+		return unaryPrecedence
+	case *IntLiteral:
+		// Negative literals are folded from a unary minus
+		if n.Value < 0 || strings.HasPrefix(n.raw, "-") {
+			return unaryPrecedence
+		}
+	case *NumberLiteral:
+		if math.Signbit(n.Value) || strings.HasPrefix(n.raw, "-") {
+			return unaryPrecedence
+		}
+	}
+	return postfixPrecedence
+}
+
+// unparseOperand writes node, parenthesized if its precedence is below min
+func unparseOperand(b *strings.Builder, node ASTNode, min int) {
+	if precedenceOf(node) < min {
+		b.WriteByte('(')
+		unparse(b, node)
+		b.WriteByte(')')
+		return
+	}
+	unparse(b, node)
+}
+
+func unparseList(b *strings.Builder, nodes []ASTNode) {
+	for i, node := range nodes {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		unparse(b, node)
+	}
+}
+
+func unparseMacro(b *strings.Builder, source ASTNode, name, variable string, body ASTNode) {
+	unparseOperand(b, source, postfixPrecedence)
+	b.WriteString("." + name + "(" + variable + ", ")
+	unparse(b, body)
+	b.WriteByte(')')
+}
+
+func unparse(b *strings.Builder, node ASTNode) {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		if n.raw != "" {
+			b.WriteString(n.raw)
+			return
+		}
+		s := strconv.FormatFloat(n.Value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		switch {
+		case math.IsInf(n.Value, 1):
+			s = `double("inf")`
+		case math.IsInf(n.Value, -1):
+			s = `double("-inf")`
+		case math.IsNaN(n.Value):
+			s = `double("nan")`
+		}
+		b.WriteString(s)
+	case *IntLiteral:
+		if n.raw != "" {
+			b.WriteString(n.raw)
+			return
+		}
+		b.WriteString(strconv.FormatInt(n.Value, 10))
+	case *UintLiteral:
+		if n.raw != "" {
+			b.WriteString(n.raw)
+			return
+		}
+		b.WriteString(strconv.FormatUint(n.Value, 10) + "u")
+	case *StringLiteral:
+		if n.raw != "" {
+			b.WriteString(n.raw)
+			return
+		}
+		b.WriteString(strconv.Quote(n.Value))
+	case *BytesLiteral:
+		if n.raw != "" {
+			b.WriteString(n.raw)
+			return
+		}
+		b.WriteString(quoteBytes(n.Value))
+	case *Template:
+		b.WriteString(`f"`)
+		for i, text := range n.Text {
+			if i > 0 {
+				// A space keeps a brace of the expression from forming
+				// the {{ or }} escape, as in f"{ {"a": 1} }"
+				expr := Unparse(n.Exprs[i-1])
+				if strings.HasPrefix(expr, "{") || strings.HasSuffix(expr, "}") {
+					expr = " " + expr + " "
+				}
+				b.WriteString("{" + expr + "}")
+			}
+			quoted := strconv.Quote(text)
+			b.WriteString(templateBraces.Replace(quoted[1 : len(quoted)-1]))
+		}
+		b.WriteByte('"')
+	case *BooleanLiteral:
+		b.WriteString(strconv.FormatBool(n.Value))
+	case *NullLiteral:
+		b.WriteString("null")
+	case *ArrayLiteral:
+		b.WriteByte('[')
+		unparseList(b, n.Elements)
+		b.WriteByte(']')
+	case *MapLiteral:
+		b.WriteByte('{')
+		for i, pair := range n.Pairs {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			unparse(b, pair.Key)
+			if pair.Value != nil {
+				b.WriteString(": ")
+				unparse(b, pair.Value)
+			}
+		}
+		b.WriteByte('}')
+	case *Identifier:
+		b.WriteString(n.Name)
+	case *Select:
+		unparseOperand(b, n.Operand, postfixPrecedence)
+		if n.Optional {
+			b.WriteByte('?')
+		}
+		if isIdentifier(n.Field) {
+			b.WriteString("." + n.Field)
+		} else {
+			b.WriteString(".`" + n.Field + "`")
+		}
+	case *Index:
+		unparseOperand(b, n.Operand, postfixPrecedence)
+		b.WriteByte('[')
+		unparse(b, n.Index)
+		b.WriteByte(']')
+	case *Slice:
+		unparseOperand(b, n.Operand, postfixPrecedence)
+		b.WriteByte('[')
+		if n.Start != nil {
+			unparse(b, n.Start)
+		}
+		b.WriteByte(':')
+		if n.End != nil {
+			unparse(b, n.End)
+		}
+		b.WriteByte(']')
+	case *BinaryOp:
+		prec := getOperatorPrecedence(n.Op)
+		unparseOperand(b, n.Left, prec)
+		b.WriteString(" " + n.Op + " ")
+		unparseOperand(b, n.Right, prec+1)
+	case *UnaryOp:
+		b.WriteString(n.Op)
+		// -(5) must keep its parentheses, or it would be read back as the
+		// literal -5
+		if n.Op == "-" && isNumberLiteral(n.Expr) && precedenceOf(n.Expr) == postfixPrecedence {
+			b.WriteByte('(')
+			unparse(b, n.Expr)
+			b.WriteByte(')')
+			return
+		}
+		unparseOperand(b, n.Expr, unaryPrecedence)
+	case *Between:
+		prec := getOperatorPrecedence("between")
+		unparseOperand(b, n.Expr, prec)
+		b.WriteString(" between ")
+		unparseOperand(b, n.Low, prec+1)
+		b.WriteString(" and ")
+		unparseOperand(b, n.High, prec+1)
+		if n.Exclusive {
+			b.WriteString(" exclusive")
+		}
+	case *Ternary:
+		unparseOperand(b, n.Cond, 1)
+		b.WriteString(" ? ")
+		unparse(b, n.Then)
+		b.WriteString(" : ")
+		unparse(b, n.Else)
+	case *Let:
+		b.WriteString("let " + n.Name + " = ")
+		unparse(b, n.Value)
+		b.WriteString("; ")
+		unparse(b, n.Body)
+	case *Lambda:
+		if len(n.Params) == 1 {
+			b.WriteString(n.Params[0])
+		} else {
+			b.WriteString("(" + strings.Join(n.Params, ", ") + ")")
+		}
+		b.WriteString(" => ")
+		unparse(b, n.Body)
+	case *FunctionCall:
+		b.WriteString(n.Name + "(")
+		unparseList(b, n.Arguments)
+		b.WriteByte(')')
+	case *MethodCall:
+		unparseOperand(b, n.Object, postfixPrecedence)
+		if n.Optional {
+			b.WriteByte('?')
+		}
+		b.WriteString("." + n.Method + "(")
+		unparseList(b, n.Arguments)
+		b.WriteByte(')')
+	case *Spread:
+		b.WriteString("...")
+		unparse(b, n.Value)
+	case *Comprehension:
+		if n.Value == nil {
+			b.WriteByte('[')
+			unparse(b, n.Key)
+		} else {
+			b.WriteByte('{')
+			unparse(b, n.Key)
+			b.WriteString(": ")
+			unparse(b, n.Value)
+		}
+		b.WriteString(" for " + strings.Join(n.Variables, ", ") + " in ")
+		unparse(b, n.Source)
+		if n.Cond != nil {
+			b.WriteString(" if ")
+			unparse(b, n.Cond)
+		}
+		if n.Value == nil {
+			b.WriteByte(']')
+		} else {
+			b.WriteByte('}')
+		}
+	case *Match:
+		b.WriteString("match ")
+		unparse(b, n.Subject)
+		b.WriteString(" {")
+		for i, arm := range n.Arms {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteByte(' ')
+			unparseArm(b, arm)
+		}
+		b.WriteString(" }")
+	case *Pipe:
+		unparseOperand(b, n.Value, getOperatorPrecedence("|>"))
+		b.WriteString(" |> ")
+		unparse(b, n.Call)
+	case *Filter:
+		unparseMacro(b, n.Source, "filter", n.Variable, n.Predicate)
+	case *Map:
+		unparseMacro(b, n.Source, "map", n.Variable, n.Transform)
+	case *All:
+		unparseMacro(b, n.Source, "all", n.Variable, n.Predicate)
+	case *Exists:
+		unparseMacro(b, n.Source, "exists", n.Variable, n.Predicate)
+	case *ExistsOne:
+		unparseMacro(b, n.Source, "exists_one", n.Variable, n.Predicate)
+	case *Find:
+		unparseMacro(b, n.Source, "find", n.Variable, n.Predicate)
+	case *Size:
+		b.WriteString("size(")
+		unparse(b, n.Expr)
+		b.WriteByte(')')
+	case *First:
+		b.WriteString("first(")
+		unparse(b, n.Expr)
+		b.WriteByte(')')
+	case *Last:
+		b.WriteString("last(")
+		unparse(b, n.Expr)
+		b.WriteByte(')')
+	case *BadExpr:
+		b.WriteString("<bad expression>")
+	default:
+		b.WriteString(node.String())
+	}
+}
+
+func unparseArm(b *strings.Builder, arm MatchArm) {
+	b.WriteString(unparsePattern(arm.Pattern))
+	if arm.Guard != nil {
+		b.WriteString(" if ")
+		unparse(b, arm.Guard)
+	}
+	b.WriteString(" => ")
+	unparse(b, arm.Body)
+}
+
+// unparsePattern returns the source form of a match pattern
+func unparsePattern(pattern Pattern) string {
+	switch pat := pattern.(type) {
+	case *WildcardPattern:
+		return "_"
+	case *BindPattern:
+		return pat.Name
+	case *LiteralPattern:
+		return Unparse(pat.Literal)
+	case *ListPattern:
+		elements := make([]string, len(pat.Elements))
+		for i, element := range pat.Elements {
+			elements[i] = unparsePattern(element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *MapPattern:
+		entries := make([]string, len(pat.Entries))
+		for i, entry := range pat.Entries {
+			entries[i] = Unparse(entry.Key) + ": " + unparsePattern(entry.Pattern)
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	}
+	return ""
+}
+
+// templateBraces doubles the braces in f-string text
+var templateBraces = strings.NewReplacer("{", "{{", "}", "}}")
+
+func isNumberLiteral(node ASTNode) bool {
+	switch node.(type) {
+	case *IntLiteral, *UintLiteral, *NumberLiteral:
+		return true
+	}
+	return false
+}
+
+// quoteBytes returns a bytes literal for data, escaping everything except
+// printable ASCII
+func quoteBytes(data []byte) string {
+	var b strings.Builder
+	b.WriteString(`b"`)
+	for _, c := range data {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			b.WriteString(`\x`)
+			b.WriteString(strconv.FormatUint(uint64(c)>>4, 16))
+			b.WriteString(strconv.FormatUint(uint64(c)&0xf, 16))
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+type formatter struct {
+	opts FormatOptions
+}
+
+// format lays out node starting at the given indentation depth
+func (f *formatter) format(node ASTNode, depth int) string {
+	flat := Unparse(node)
+	if len(strings.Repeat(f.opts.Indent, depth))+len(flat) <= f.opts.MaxWidth {
+		return flat
+	}
+
+	newline := "\n" + strings.Repeat(f.opts.Indent, depth+1)
+	switch n := node.(type) {
+	case *BinaryOp:
+		if n.Op != "&&" && n.Op != "||" {
+			return flat
+		}
+		var b strings.Builder
+		for i, operand := range flattenChain(n) {
+			min := getOperatorPrecedence(n.Op)
+			if i > 0 {
+				b.WriteString(newline + n.Op + " ")
+				min++
+			}
+			b.WriteString(f.formatOperand(operand, min, depth+1))
+		}
+		return b.String()
+	case *Ternary:
+		var b strings.Builder
+		b.WriteString(f.formatOperand(n.Cond, 1, depth+1))
+		b.WriteString(newline + "? " + f.format(n.Then, depth+1))
+		b.WriteString(newline + ": " + f.format(n.Else, depth+1))
+		return b.String()
+	case *Match:
+		var b strings.Builder
+		b.WriteString("match " + f.format(n.Subject, depth) + " {")
+		for _, arm := range n.Arms {
+			var line strings.Builder
+			unparseArm(&line, arm)
+			b.WriteString(newline + line.String() + ",")
+		}
+		b.WriteString("\n" + strings.Repeat(f.opts.Indent, depth) + "}")
+		return b.String()
+	case *Let:
+		return "let " + n.Name + " = " + f.format(n.Value, depth) + ";\n" +
+			strings.Repeat(f.opts.Indent, depth) + f.format(n.Body, depth)
+	}
+	return flat
+}
+
+// formatOperand formats an operand, parenthesizing it if its precedence is
+// below min
+func (f *formatter) formatOperand(node ASTNode, min, depth int) string {
+	if precedenceOf(node) < min {
+		return "(" + f.format(node, depth) + ")"
+	}
+	return f.format(node, depth)
+}
+
+// flattenChain returns the operands of a left-associative chain of the same
+// boolean operator, such as a && b && c
+func flattenChain(n *BinaryOp) []ASTNode {
+	if left, ok := n.Left.(*BinaryOp); ok && left.Op == n.Op {
+		return append(flattenChain(left), n.Right)
+	}
+	return []ASTNode{n.Left, n.Right}
+}
@@ -49,6 +49,7 @@ func main() {
 		"lower(name)",
 		"trim(\"  hello world  \")",
 		"name + \" is \" + string(age) + \" years old\"",
+		"f\"{name} is {age} years old\"",
 
 		// Math functions
 		"abs(-42)",
@@ -1,7 +1,13 @@
 package cel
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSimpleArithmetic(t *testing.T) {
@@ -11,14 +17,14 @@ func TestSimpleArithmetic(t *testing.T) {
 		expr     string
 		expected interface{}
 	}{
-		{"1 + 2", 3.0},
-		{"5 - 3", 2.0},
-		{"4 * 2", 8.0},
-		{"10 / 2", 5.0},
-		{"2 ^ 3", 8.0},
+		{"1 + 2", int64(3)},
+		{"5 - 3", int64(2)},
+		{"4 * 2", int64(8)},
+		{"10 / 2", int64(5)},
+		{"2 ^ 3", int64(8)},
 		{"upper(\"hello\")", "HELLO"},
 		{"lower(\"WORLD\")", "world"},
-		{"abs(-5)", 5.0},
+		{"abs(-5)", int64(5)},
 	}
 
 	for _, test := range tests {
@@ -122,3 +128,1785 @@ func BenchmarkMapTransform(b *testing.B) {
 		_, _ = expr.Evaluate(ctx)
 	}
 }
+
+func evalExpr(t *testing.T, ctx *Context, expr string) (Value, error) {
+	t.Helper()
+	parser := NewParser(expr)
+	compiled, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return compiled.Evaluate(ctx)
+}
+
+type testAddress struct {
+	City string `json:"city"`
+	Zip  string
+}
+
+type testCustomer struct {
+	Name    string
+	Address *testAddress
+}
+
+func TestFieldSelection(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["user"] = map[string]Value{"name": "Alice", "age": 30.0}
+	ctx.Variables["order"] = map[string]any{
+		"customer": testCustomer{Name: "Bob", Address: &testAddress{City: "Oslo", Zip: "0150"}},
+	}
+	ctx.Variables["labels"] = map[string]string{"env": "prod"}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"user.name", "Alice"},
+		{"user.age + 1", 31.0},
+		{"order.customer.Name", "Bob"},
+		{"order.customer.address.city", "Oslo"},
+		{"order.customer.Address.zip", "0150"},
+		{"labels.env", "prod"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	_, err := evalExpr(t, ctx, "order.customer.address.country")
+	var keyErr *NoSuchKeyError
+	if !errors.As(err, &keyErr) || keyErr.Path != "order.customer.address.country" {
+		t.Errorf("Expected no such key error, got %v", err)
+	}
+}
+
+func TestIndexAndSlice(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["items"] = []Value{"a", "b", "c"}
+	ctx.Variables["headers"] = map[string]Value{"x-request-id": "42"}
+	ctx.Variables["name"] = "Alexander"
+	ctx.Variables["ids"] = []int{7, 8, 9}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"items[0]", "a"},
+		{"items[-1]", "c"},
+		{"items[1 + 1]", "c"},
+		{"headers[\"x-request-id\"]", "42"},
+		{"name[0]", "A"},
+		{"name[0:3]", "Ale"},
+		{"name[-3:]", "der"},
+		{"ids[1]", 8},
+		{"size(items[1:])", int64(2)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	for _, expr := range []string{"items[3]", "items[-4]", "name[2:20]"} {
+		_, err := evalExpr(t, ctx, expr)
+		var rangeErr *IndexOutOfRangeError
+		if !errors.As(err, &rangeErr) {
+			t.Errorf("%s: expected IndexOutOfRangeError, got %v", expr, err)
+		}
+	}
+}
+
+func TestListAndMapLiterals(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["x"] = 5.0
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"size([1, 2, 3])", int64(3)},
+		{"[1, 2, 3,][2]", int64(3)},
+		{"size([])", int64(0)},
+		{"[[1, 2], [3, x]][1][1]", 5.0},
+		{"{\"a\": 1, \"b\": {\"c\": x},}.b.c", 5.0},
+		{"{\"a\": [1, 2]}[\"a\"][0]", int64(1)},
+		{"{1: \"one\", 2: \"two\"}[2]", "two"},
+		{"{true: \"yes\", false: \"no\"}[x > 3]", "yes"},
+		{"size({})", int64(0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	if _, err := evalExpr(t, ctx, "{\"a\": 1, \"a\": 2}"); err == nil {
+		t.Error("Expected duplicate key error")
+	}
+	if _, err := evalExpr(t, ctx, "{[1]: 2}"); err == nil {
+		t.Error("Expected unsupported key type error")
+	}
+}
+
+func TestTernary(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["tier"] = "silver"
+	ctx.Variables["amount"] = 150.0
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"amount > 100 ? \"high\" : \"low\"", "high"},
+		{"amount > 100 && tier == \"gold\" ? 1 : 2", int64(2)},
+		{"tier == \"gold\" ? 0.2 : tier == \"silver\" ? 0.1 : 0.0", 0.1},
+		{"tier == \"gold\" ? 0.2 : tier == \"bronze\" ? 0.1 : 0.0", 0.0},
+		{"(amount > 100 ? 2 : 1) * 10", int64(20)},
+		{"true ? false ? 1 : 2 : 3", int64(2)},
+		{"[amount > 100 ? \"a\" : \"b\"][0]", "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestInAndBetween(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["roles"] = []Value{"admin", "editor"}
+	ctx.Variables["headers"] = map[string]Value{"accept": "json"}
+	ctx.Variables["age"] = 30
+	ctx.Variables["start"] = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx.Variables["end"] = time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	ctx.Variables["ts"] = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"\"admin\" in roles", true},
+		{"\"viewer\" in roles", false},
+		{"2 in [1, 2, 3]", true},
+		{"\"accept\" in headers", true},
+		{"\"host\" in headers", false},
+		{"\"ell\" in \"hello\"", true},
+		{"!(\"admin\" in roles) || age > 18", true},
+		{"age between 18 and 65", true},
+		{"age between 30 and 65", true},
+		{"age between 30 and 65 exclusive", false},
+		{"age between 18 and 65 inclusive && true", true},
+		{"age + 40 between 18 and 65", false},
+		{"\"m\" between \"a\" and \"z\"", true},
+		{"ts between start and end", true},
+		{"start between ts and end", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	if _, err := evalExpr(t, ctx, "\"a\" between 1 and 2"); err == nil {
+		t.Error("Expected error comparing string with numbers")
+	}
+}
+
+func TestReceiverMacros(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["numbers"] = []Value{1.0, 2.0, 3.0, 4.0, 5.0, 6.0}
+	ctx.Variables["items"] = []Value{
+		map[string]Value{"name": "pen", "price": 5.0},
+		map[string]Value{"name": "book", "price": 12.0},
+		map[string]Value{"name": "lamp", "price": 30.0},
+	}
+	ctx.Variables["i"] = "outer"
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"size(items.filter(i, i.price > 10))", int64(2)},
+		{"items.filter(i, i.price > 10).map(i, i.name)[1]", "lamp"},
+		{"numbers.map(n, n * 2).filter(n, n > 6).size()", int64(3)},
+		{"numbers.all(n, n > 0)", true},
+		{"numbers.exists(n, n > 5)", true},
+		{"numbers.exists_one(n, n > 5)", true},
+		{"numbers.exists_one(n, n > 4)", false},
+		{"[1, 2, 3, \"x\"].exists_one(n, n > 1)", false},
+		{"exists_one(n, numbers, n == 3)", true},
+		{"items.find(i, i.price > 10).name", "book"},
+		{"[1, 2, 3].map(x, x + 1)[2]", int64(4)},
+		{"numbers.sum()", 21.0},
+		{"\"hello\".upper()", "HELLO"},
+		{"\" a \".trim().upper().size()", int64(1)},
+		{"numbers.filter(i, i > 2).size() > 0 && i == \"outer\"", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	// A failing built-in method is reported rather than retried as the
+	// function of the same name
+	for _, expr := range []string{"\"abc\".size(1)", "numbers.size(1)"} {
+		if _, err := evalExpr(t, ctx, expr); err == nil || !strings.Contains(err.Error(), "takes no arguments") {
+			t.Errorf("%s: expected method error, got %v", expr, err)
+		}
+	}
+
+	if ctx.Variables["i"] != "outer" {
+		t.Errorf("macro variable leaked: i = %v", ctx.Variables["i"])
+	}
+	if _, ok := ctx.Variables["n"]; ok {
+		t.Error("macro variable n leaked into context")
+	}
+}
+
+type testFunc func(ctx context.Context, args ...Value) (Value, error)
+
+func (f testFunc) Call(ctx context.Context, args ...Value) (Value, error) {
+	return f(ctx, args...)
+}
+
+func TestLambdas(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["id"] = "abc"
+	ctx.Variables["items"] = []Value{
+		map[string]Value{"name": "lamp", "price": 30.0},
+		map[string]Value{"name": "pen", "price": 5.0},
+	}
+
+	attempts := 0
+	ctx.RegisterFunction("fetch", testFunc(func(ctx context.Context, args ...Value) (Value, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("unavailable")
+		}
+		return "fetched " + args[0].(string), nil
+	}))
+	ctx.RegisterFunction("retry", testFunc(func(ctx context.Context, args ...Value) (Value, error) {
+		var lastErr error
+		for i := int64(0); i < args[0].(int64); i++ {
+			result, err := Invoke(ctx, args[1])
+			if err == nil {
+				return result, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}))
+	ctx.RegisterFunction("sortBy", testFunc(func(ctx context.Context, args ...Value) (Value, error) {
+		sorted := append([]Value(nil), args[0].([]Value)...)
+		key := args[1].(LambdaFunc)
+		var sortErr error
+		sort.SliceStable(sorted, func(i, j int) bool {
+			a, err := key(ctx, sorted[i])
+			if err != nil {
+				sortErr = err
+			}
+			b, err := key(ctx, sorted[j])
+			if err != nil {
+				sortErr = err
+			}
+			return evaluateLessThan(a, b)
+		})
+		return sorted, sortErr
+	}))
+
+	result, err := evalExpr(t, ctx, "retry(3, () => fetch(id))")
+	if err != nil || result != "fetched abc" {
+		t.Fatalf("retry: got %v, %v", result, err)
+	}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"sortBy(items, x => x.price)[0].name", "pen"},
+		{"sortBy(items, (x) => -x.price)[0].name", "lamp"},
+		{"sortBy([3, 1, 2], x => x)[0]", int64(1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	fn, err := evalExpr(t, ctx, "(a, b) => a + b + size(id)")
+	if err != nil {
+		t.Fatalf("Evaluation failed: %v", err)
+	}
+	sum, err := Invoke(ctx, fn, 1.0, 2.0)
+	if err != nil || sum != 6.0 {
+		t.Errorf("Expected 6, got %v, %v", sum, err)
+	}
+	if _, err := Invoke(ctx, fn, 1.0); err == nil {
+		t.Error("Expected arity error")
+	}
+	if _, ok := ctx.Variables["a"]; ok {
+		t.Error("lambda parameter leaked into context")
+	}
+
+	// Lambdas created by a macro keep the element they were created for
+	adders, err := evalExpr(t, ctx, "let fs = [1, 2, 3].map(x, y => x + y); fs.map(g, g(10))")
+	if err != nil || fmt.Sprint(adders) != "[11 12 13]" {
+		t.Errorf("Expected [11 12 13], got %v, %v", adders, err)
+	}
+}
+
+func TestLetBindings(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["items"] = []Value{50.0, 60.0, 70.0}
+	ctx.Variables["total"] = "outer"
+
+	calls := 0
+	ctx.RegisterFunction("expensive", testFunc(func(ctx context.Context, args ...Value) (Value, error) {
+		calls++
+		return args[0], nil
+	}))
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"let total = sum(items); total > 100 && total < 500", true},
+		{"let a = 2; let b = a * 3; a + b", int64(8)},
+		{"let x = 1; let x = x + 1; x", int64(2)},
+		{"cel.bind(t, sum(items), t / 3)", 60.0},
+		{"let f = x => x * 10; f(4)", int64(40)},
+		{"let n = 100; items.map(n, n + 1)[0]", 51.0},
+		{"let t = expensive(5); t + t + t", int64(15)},
+		{"let unused = undefinedVar; 1", int64(1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected let value to be evaluated once, got %d", calls)
+	}
+	if ctx.Variables["total"] != "outer" || len(ctx.Variables) != 2 {
+		t.Errorf("let binding leaked into context: %v", ctx.Variables)
+	}
+
+	// let is only a keyword where it starts a binding
+	named := NewContext()
+	named.Variables["let"] = int64(1)
+	named.Variables["config"] = map[string]Value{"let": "field"}
+	for expr, expected := range map[string]Value{
+		"let + 1":                  int64(2),
+		"config.let":               "field",
+		"[let, let][1]":            int64(1),
+		"let let = let + 1; let":   int64(2),
+		"let x = let * 5; x + let": int64(6),
+	} {
+		if result, err := evalExpr(t, named, expr); err != nil || result != expected {
+			t.Errorf("%s: expected %v, got %v, %v", expr, expected, result, err)
+		}
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	ctx := NewContext()
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{`"a\\nb"`, `a\nb`},
+		{`"tab\there"`, "tab\there"},
+		{`'it\'s'`, "it's"},
+		{`"\u00e9t\u00E9"`, "été"},
+		{`"\U0001F600"`, "😀"},
+		{`"\x41\101\x7e"`, "AA~"},
+		{`"\a\b\f\r\v\?\` + "`" + `"`, "\a\b\f\r\v?`"},
+		{`r"C:\path\n"`, `C:\path\n`},
+		{`R'\d+'`, `\d+`},
+		{"\"\"\"line one\nline \"two\" \"\"\"", "line one\nline \"two\" "},
+		{"'''a\n'b'\n'''", "a\n'b'\n"},
+		{`"héllo" + 'wörld'`, "héllowörld"},
+		{`size("héllo")`, int64(6)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+
+	bytesTests := []struct {
+		expr     string
+		expected []byte
+	}{
+		{`b"abc"`, []byte("abc")},
+		{`b"\xff\000\x41"`, []byte{0xff, 0x00, 0x41}},
+		{`B'\303\251'`, []byte("é")},
+		{`rb"\x00"`, []byte(`\x00`)},
+		{`b"é"`, []byte("é")},
+	}
+
+	for _, test := range bytesTests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if b, ok := result.([]byte); !ok || string(b) != string(test.expected) {
+				t.Errorf("Expected %v, got %#v", test.expected, result)
+			}
+		})
+	}
+
+	invalid := []struct {
+		expr   string
+		offset int
+	}{
+		{`"abc\q"`, 4},
+		{`"ok" + "\uZZZZ"`, 8},
+		{`b"\u00e9"`, 2},
+		{`"\400"`, 1},
+		{`"\uD800"`, 1},
+		{`"unterminated`, 0},
+		{"\"line\nbreak\"", 5},
+	}
+
+	for _, test := range invalid {
+		_, err := NewParser(test.expr).Parse()
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Offset != test.offset {
+			t.Errorf("%s: expected error at offset %d, got %v", test.expr, test.offset, err)
+		}
+	}
+}
+
+func TestNumericTypes(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["count"] = 7
+	ctx.Variables["ratio"] = float32(0.5)
+	ctx.Variables["flags"] = uint8(3)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"7 / 2", int64(3)},
+		{"-7 / 2", int64(-3)},
+		{"-7 % 3", int64(-1)},
+		{"7.0 / 2", 3.5},
+		{"7 / 2.0", 3.5},
+		{"1e3", 1000.0},
+		{"0x1F", int64(31)},
+		{"0XffU", uint64(255)},
+		{"5u + 3u", uint64(8)},
+		{"10u / 3u", uint64(3)},
+		{"1_000_000", int64(1000000)},
+		{"9007199254740993", int64(9007199254740993)},
+		{"18446744073709551615u", uint64(18446744073709551615)},
+		{"-9223372036854775808", int64(-9223372036854775808)},
+		{"count * 2", int64(14)},
+		{"ratio * 2", 1.0},
+		{"flags + 1u", uint64(4)},
+		{"1 == 1.0", true},
+		{"1u == 1", true},
+		{"2 < 2.5", true},
+		{"int(3.9)", int64(3)},
+		{"int(\"42\")", int64(42)},
+		{"uint(42)", uint64(42)},
+		{"double(7) / 2", 3.5},
+		{"[1, 2, 3][1u]", int64(2)},
+		{"{1: \"one\"}[1.0]", "one"},
+		{"-1 ^ 3", int64(-1)},
+		{"(-1) ^ 3", int64(-1)},
+		{"-1 ^ 4", int64(1)},
+		{"2 ^ 62", int64(4611686018427387904)},
+		{"3u ^ 5u", uint64(243)},
+		{"2.0 ^ -1", 0.5},
+		{"-5.abs()", int64(-5)},
+		{"(-5).abs()", int64(5)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v (%T), got %v (%T)", test.expected, test.expected, result, result)
+			}
+		})
+	}
+
+	for _, expr := range []string{
+		"9223372036854775807 + 1",
+		"-9223372036854775808 - 1",
+		"-9223372036854775808 / -1",
+		"0u - 1u",
+		"1 / 0",
+		"1 % 0",
+		"1 + 1u",
+		"uint(-1)",
+		"int(1e19)",
+		"2 ^ 63",
+		"2 ^ -1",
+		"2u ^ 64u",
+	} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+
+	for _, expr := range []string{"9223372036854775808", "18446744073709551616u", "0x"} {
+		if _, err := NewParser(expr).Parse(); err == nil {
+			t.Errorf("%s: expected parse error", expr)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		line     int
+		column   int
+		expected []string
+		snippet  string
+	}{
+		{"(1 + 2", 1, 7, []string{"')'"}, "(1 + 2\n      ^"},
+		{"size(items", 1, 11, []string{"','", "')'"}, "size(items\n          ^"},
+		{"a &&\n\tb +", 2, 5, []string{"expression"}, "\tb +\n\t   ^"},
+		{"[1, 2 3]", 1, 7, []string{"','", "']'"}, "[1, 2 3]\n      ^"},
+		{"x > 1 ? \"a\"", 1, 12, []string{"':'"}, "x > 1 ? \"a\"\n           ^"},
+		{"user.", 1, 6, []string{"field name"}, "user.\n     ^"},
+		{"\"é\" + $", 1, 7, nil, "\"é\" + $\n      ^"},
+		{"1 2", 1, 3, nil, "1 2\n  ^"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			_, err := NewParser(test.expr).Parse()
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected ParseError, got %v", err)
+			}
+			if parseErr.Line != test.line || parseErr.Column != test.column {
+				t.Errorf("Expected line %d, column %d, got line %d, column %d",
+					test.line, test.column, parseErr.Line, parseErr.Column)
+			}
+			if strings.Join(parseErr.Expected, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("Expected %v, got %v", test.expected, parseErr.Expected)
+			}
+			if parseErr.Snippet != test.snippet {
+				t.Errorf("Expected snippet:\n%s\ngot:\n%s", test.snippet, parseErr.Snippet)
+			}
+		})
+	}
+
+	_, err := NewParser("(1 + 2").Parse()
+	if err == nil || err.Error() != "syntax error at line 1, column 7: expected ')', found end of expression" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+	expr := "user.age > 18 &&\n" +
+		"  size(user.roles,) > 0 &&\n" +
+		"  [1 2] == items &&\n" +
+		"  {\"a\" 1}.a == (5 * )"
+
+	compiled, err := NewParser(expr).Parse()
+	var errs ParseErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ParseErrors, got %v", err)
+	}
+
+	expected := []struct {
+		line, column int
+		message      string
+	}{
+		{2, 19, "expected expression, found ')'"},
+		{3, 6, "expected ',' or ']', found '2'"},
+		{4, 8, "expected ':', found '1'"},
+		{4, 21, "expected expression, found ')'"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, want := range expected {
+		if errs[i].Line != want.line || errs[i].Column != want.column || errs[i].Message != want.message {
+			t.Errorf("error %d: expected %d:%d %s, got %d:%d %s", i,
+				want.line, want.column, want.message, errs[i].Line, errs[i].Column, errs[i].Message)
+		}
+	}
+	if !strings.HasSuffix(err.Error(), "(and 3 more errors)") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+
+	// The partial AST keeps the well-formed parts of the expression
+	root, ok := compiled.AST().(*BinaryOp)
+	if !ok || root.Op != "&&" {
+		t.Fatalf("Expected && at the root, got %v", compiled.AST())
+	}
+	cmp, ok := root.Right.(*BinaryOp)
+	if !ok {
+		t.Fatalf("Expected comparison, got %v", root.Right)
+	}
+	group, ok := cmp.Right.(*BinaryOp)
+	if !ok {
+		t.Fatalf("Expected 5 * <bad expression>, got %v", cmp.Right)
+	}
+	bad, ok := group.Right.(*BadExpr)
+	if !ok || bad.From != strings.LastIndex(expr, ")") {
+		t.Errorf("Expected BadExpr at the closing parenthesis, got %#v", group.Right)
+	}
+
+	if _, err := compiled.Evaluate(NewContext()); err == nil {
+		t.Error("Expected evaluating a partial AST to fail")
+	}
+
+	_, err = NewParser("a # b + $").Parse()
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Errorf("Expected 3 errors, got %v", err)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	expr := "size(items) > 2 && (user.name + \"!\").upper() == -5"
+	compiled, err := NewParser(expr).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	text := func(node ASTNode) string {
+		span := node.(Spanned).Span()
+		return expr[span.Start:span.End]
+	}
+
+	root := compiled.AST().(*BinaryOp)
+	left := root.Left.(*BinaryOp)
+	right := root.Right.(*BinaryOp)
+	method := right.Left.(*MethodCall)
+	concat := method.Object.(*BinaryOp)
+
+	tests := []struct {
+		node     ASTNode
+		expected string
+	}{
+		{root, expr},
+		{left, "size(items) > 2"},
+		{left.Left, "size(items)"},
+		{left.Left.(*FunctionCall).Arguments[0], "items"},
+		{right, "(user.name + \"!\").upper() == -5"},
+		{method, "(user.name + \"!\").upper()"},
+		{concat, "user.name + \"!\""},
+		{concat.Left, "user.name"},
+		{concat.Right, "\"!\""},
+		{right.Right, "-5"},
+	}
+
+	for _, test := range tests {
+		if got := text(test.node); got != test.expected {
+			t.Errorf("Expected span %q, got %q", test.expected, got)
+		}
+	}
+
+	ctx := NewContext()
+	ctx.Variables["a"] = 10
+	ctx.Variables["b"] = 0
+	ctx.Variables["user"] = map[string]Value{"name": "Alice"}
+
+	evalTests := []struct {
+		expr   string
+		source string
+		start  int
+	}{
+		{"a + a / b * 2", "a / b", 4},
+		{"a > 1 && missing == 2", "missing", 9},
+		{"[1, 2, user.age][0]", "user.age", 7},
+		{"let f = x => x / b; f(1) + 1", "x / b", 13},
+	}
+
+	for _, test := range evalTests {
+		t.Run(test.expr, func(t *testing.T) {
+			_, err := evalExpr(t, ctx, test.expr)
+			var evalErr *EvalError
+			if !errors.As(err, &evalErr) {
+				t.Fatalf("Expected EvalError, got %v", err)
+			}
+			if evalErr.Source != test.source || evalErr.Span.Start != test.start {
+				t.Errorf("Expected %q at %d, got %q at %d", test.source, test.start, evalErr.Source, evalErr.Span.Start)
+			}
+		})
+	}
+}
+
+func TestUnparse(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"1+2*3", "1 + 2 * 3"},
+		{"(1 + 2) * 3", "(1 + 2) * 3"},
+		{"(1 - 2) - 3", "1 - 2 - 3"},
+		{"1 - (2 - 3)", "1 - (2 - 3)"},
+		{"-(5)", "-(5)"},
+		{"-(-5)", "--5"},
+		{"(-x).y", "(-x).y"},
+		{"!(a && b) || (c)", "!(a && b) || c"},
+		{"a ? b : (c ? d : e)", "a ? b : c ? d : e"},
+		{"(a ? b : c) ? d : e", "(a ? b : c) ? d : e"},
+		{"(let x = 1; x) + 1", "(let x = 1; x) + 1"},
+		{"cel.bind(t, 1, t * 2)", "let t = 1; t * 2"},
+		{"f(x=>x+1, (a,b)=>a, ()=>1)", "f(x => x + 1, (a, b) => a, () => 1)"},
+		{"filter(n, numbers, n > 5)", "filter(n, numbers, n > 5)"},
+		{"items.filter(i, i.price > 10).map(i, i.name)", "items.filter(i, i.price > 10).map(i, i.name)"},
+		{"x between 1 + 1 and (2 between 1 and 3) exclusive", "x between 1 + 1 and (2 between 1 and 3) exclusive"},
+		{"{'a': [1, 2,], 1: b\"x\"}['a'][0:1]", "{'a': [1, 2], 1: b\"x\"}['a'][0:1]"},
+		{"name[:3] + name[1:]", "name[:3] + name[1:]"},
+		{"0x1F + 5u + 1e3 + r\"\\d\"", "0x1F + 5u + 1e3 + r\"\\d\""},
+		{"2 ^ (3 ^ 2)", "2 ^ (3 ^ 2)"},
+		{"a in [1,2] && !(b in c)", "a in [1, 2] && !(b in c)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			compiled, err := NewParser(test.expr).Parse()
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if got := compiled.String(); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+
+			reparsed, err := NewParser(compiled.String()).Parse()
+			if err != nil {
+				t.Fatalf("Reparse failed: %v", err)
+			}
+			if reparsed.String() != compiled.String() {
+				t.Errorf("Round trip changed %s to %s", compiled, reparsed)
+			}
+		})
+	}
+
+	built := &BinaryOp{
+		Op:    "+",
+		Left:  &UnaryOp{Op: "-", Expr: &IntLiteral{Value: 5}},
+		Right: &ArrayLiteral{Elements: []ASTNode{&NumberLiteral{Value: 2}, &UintLiteral{Value: 3}, &StringLiteral{Value: "a\"b"}, &BytesLiteral{Value: []byte{0xff, 'x'}}}},
+	}
+	if got, expected := Unparse(built), `-(5) + [2.0, 3u, "a\"b", b"\xffx"]`; got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	expr := `user.age >= 18 && user.country in ["NO", "SE", "DK"] && (user.role == "admin" || user.role == "editor" && user.verified) && !user.banned`
+	compiled, err := NewParser(expr).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	expected := `user.age >= 18
+  && user.country in ["NO", "SE", "DK"]
+  && (user.role == "admin"
+    || user.role == "editor" && user.verified)
+  && !user.banned`
+	got := Format(compiled.AST(), FormatOptions{MaxWidth: 50})
+	if got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	reparsed, err := NewParser(got).Parse()
+	if err != nil || reparsed.String() != compiled.String() {
+		t.Errorf("Formatted expression does not round trip: %v", err)
+	}
+
+	if got := Format(compiled.AST(), FormatOptions{MaxWidth: 200}); got != compiled.String() {
+		t.Errorf("Expected single line, got %s", got)
+	}
+
+	compiled, err = NewParser(`let limit = account.tier == "gold" ? 1000 : 100; total <= limit`).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	expected = "let limit = account.tier == \"gold\"\n\t? 1000\n\t: 100;\ntotal <= limit"
+	if got := Format(compiled.AST(), FormatOptions{MaxWidth: 30, Indent: "\t"}); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+type countingVisitor map[string]int
+
+func (v countingVisitor) Visit(node ASTNode) Visitor {
+	if node != nil {
+		v[strings.TrimPrefix(fmt.Sprintf("%T", node), "*cel.")]++
+	}
+	return v
+}
+
+func TestWalkAndRewrite(t *testing.T) {
+	compiled, err := NewParser(`let limit = 10; items.filter(i, i.price > limit).map(i, upper(i.name))[0:1][0] == "A" ? true : false`).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	counts := countingVisitor{}
+	Walk(counts, compiled.AST())
+	expected := map[string]int{
+		"Let": 1, "IntLiteral": 4, "Index": 1, "Ternary": 1, "BinaryOp": 2, "Slice": 1, "Map": 1, "Filter": 1,
+		"Identifier": 4, "Select": 2, "FunctionCall": 1, "StringLiteral": 1, "BooleanLiteral": 2,
+	}
+	for kind, n := range expected {
+		if counts[kind] != n {
+			t.Errorf("Expected %d %s nodes, got %d", n, kind, counts[kind])
+		}
+	}
+
+	var names []string
+	Inspect(compiled.AST(), func(node ASTNode) bool {
+		if _, ok := node.(*Lambda); ok {
+			return false
+		}
+		if ident, ok := node.(*Identifier); ok {
+			names = append(names, ident.Name)
+		}
+		return true
+	})
+	if strings.Join(names, ",") != "items,i,limit,i" {
+		t.Errorf("Unexpected identifiers: %v", names)
+	}
+
+	// Rename a variable, replace a deprecated function and inject a tenant
+	// filter around the whole rule
+	original := compiled.String()
+	rewritten := compiled.Rewrite(func(node ASTNode) ASTNode {
+		switch n := node.(type) {
+		case *Identifier:
+			if n.Name == "items" {
+				return &Identifier{Name: "products"}
+			}
+		case *FunctionCall:
+			if n.Name == "upper" {
+				return &MethodCall{Object: n.Arguments[0], Method: "upper"}
+			}
+		}
+		return node
+	})
+	tenant := &BinaryOp{Op: "==", Left: &Identifier{Name: "tenant"}, Right: &StringLiteral{Value: "acme"}}
+	rewritten = NewExpression(&BinaryOp{Op: "&&", Left: tenant, Right: rewritten.AST()})
+
+	if compiled.String() != original {
+		t.Errorf("Rewrite modified the original AST: %s", compiled)
+	}
+	expectedSource := `tenant == "acme" && (let limit = 10; products.filter(i, i.price > limit).map(i, i.name.upper())[0:1][0] == "A" ? true : false)`
+	if rewritten.String() != expectedSource {
+		t.Errorf("Expected %s, got %s", expectedSource, rewritten)
+	}
+
+	ctx := NewContext()
+	ctx.Variables["tenant"] = "acme"
+	ctx.Variables["products"] = []Value{map[string]Value{"name": "a", "price": 20}}
+	result, err := rewritten.Evaluate(ctx)
+	if err != nil {
+		t.Fatalf("Evaluation failed: %v", err)
+	}
+	if result != true {
+		t.Errorf("Expected true, got %v", result)
+	}
+
+	ctx.Variables["tenant"] = "other"
+	if result, err := rewritten.Evaluate(ctx); err != nil || result != false {
+		t.Errorf("Expected false for another tenant, got %v, %v", result, err)
+	}
+
+	// Spans of rewritten nodes no longer point into the original source,
+	// while untouched nodes keep theirs
+	compiled, err = NewParser("items.name + missing").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rename := func(node ASTNode) ASTNode {
+		if ident, ok := node.(*Identifier); ok && ident.Name == "items" {
+			return &Identifier{Name: "products"}
+		}
+		return node
+	}
+	rewritten = compiled.Rewrite(rename)
+	sum := rewritten.AST().(*BinaryOp)
+	if span := sum.Span(); span != (Span{}) {
+		t.Errorf("Expected rewritten node to have no span, got %v", span)
+	}
+	if span := sum.Right.(Spanned).Span(); span != (Span{Start: 13, End: 20}) {
+		t.Errorf("Expected untouched node to keep its span, got %v", span)
+	}
+	ctx.Variables["products"] = map[string]Value{}
+	var evalErr *EvalError
+	if _, err := rewritten.Evaluate(ctx); !errors.As(err, &evalErr) || evalErr.Source != "" {
+		t.Errorf("Expected error without source text, got %v", err)
+	}
+
+	// A node injected from another source must not be described with the
+	// text of this one
+	compiled, err = NewParser("aaaaaaaaaaaaaaaa && flag").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected, err := NewParser("1 / 0 == 1").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten = compiled.Rewrite(func(node ASTNode) ASTNode {
+		if op, ok := node.(*BinaryOp); ok && op.Op == "&&" {
+			return &BinaryOp{Op: "&&", Left: injected.AST(), Right: op}
+		}
+		return node
+	})
+	if _, err := rewritten.Evaluate(ctx); !errors.As(err, &evalErr) || err.Error() != "division by zero" {
+		t.Errorf("Expected division by zero without source text, got %v", err)
+	}
+
+	// Without replacements the source is kept
+	unchanged := compiled.Rewrite(func(node ASTNode) ASTNode { return node })
+	if _, err := unchanged.Evaluate(ctx); !errors.As(err, &evalErr) || evalErr.Source != "aaaaaaaaaaaaaaaa" {
+		t.Errorf("Expected error located at aaaaaaaaaaaaaaaa, got %v", err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	tests := []struct {
+		expr      string
+		variables string
+		fields    string
+		functions string
+	}{
+		{
+			"user.age > 18 && size(order.items) > 0 && custom_func(user.name)",
+			"order,user", "order.items,user.age,user.name", "custom_func,size",
+		},
+		{"filter(n, numbers, n > 5)", "numbers", "", ""},
+		{"items.filter(i, i.price > limit).map(i, i.name.upper())", "items,limit", "", "upper"},
+		{"order.items[0].price + order.customer.address.city.size()", "order", "order.customer.address.city,order.items", "size"},
+		{"let total = sum(cart.items); total > threshold", "cart,threshold", "cart.items", "sum"},
+		{"retry(3, () => fetch(id)) + sortBy(users, u => u.age)", "id,users", "", "fetch,retry,sortBy"},
+		{"let f = x => x * rate; f(1) + g(2)", "rate", "", "g"},
+		{"[1, 2].exists(n, n == n.value) || n.value > 0", "n", "n.value", ""},
+		{"{\"a\": req.headers[\"x-id\"]}.a between lo and hi ? a : b", "a,b,hi,lo,req", "req.headers", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			compiled, err := NewParser(test.expr).Parse()
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			refs := compiled.References()
+			if got := strings.Join(refs.Variables, ","); got != test.variables {
+				t.Errorf("Expected variables %s, got %s", test.variables, got)
+			}
+			if got := strings.Join(refs.Fields, ","); got != test.fields {
+				t.Errorf("Expected fields %s, got %s", test.fields, got)
+			}
+			if got := strings.Join(refs.Functions, ","); got != test.functions {
+				t.Errorf("Expected functions %s, got %s", test.functions, got)
+			}
+		})
+	}
+}
+
+func TestComments(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["user"] = map[string]Value{"age": 30, "country": "NO"}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"// adults only\nuser.age >= 18", true},
+		{"user.age >= 18 // adults only", true},
+		{"user.age /* years */ / 2", int64(15)},
+		{"user.age >= 18 && /* nordic\n countries */ user.country in [\"NO\", // Norway\n \"SE\"]", true},
+		{"\"// not a comment\"", "// not a comment"},
+		{"'/* nor this */'", "/* nor this */"},
+		{"10/2", int64(5)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	_, err := NewParser("1 + /* oops").Parse()
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Offset != 4 || parseErr.Message != "unterminated comment" {
+		t.Errorf("Expected unterminated comment error, got %v", err)
+	}
+
+	source := "a /* x */ + // y\n  b"
+	tokens, err := Tokenize(source)
+	if err != nil {
+		t.Fatalf("Tokenize failed: %v", err)
+	}
+	var rebuilt strings.Builder
+	var kinds []TokenType
+	for _, token := range tokens {
+		rebuilt.WriteString(source[token.Pos:token.End])
+		kinds = append(kinds, token.Type)
+	}
+	if rebuilt.String() != source {
+		t.Errorf("Expected tokens to cover the source, got %q", rebuilt.String())
+	}
+	expectedKinds := []TokenType{
+		TokenIdentifier, TokenWhitespace, TokenComment, TokenWhitespace, TokenOperator,
+		TokenWhitespace, TokenComment, TokenWhitespace, TokenIdentifier, TokenEOF,
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint(expectedKinds) {
+		t.Errorf("Expected token types %v, got %v", expectedKinds, kinds)
+	}
+	if tokens[2].Value != "/* x */" || tokens[6].Value != "// y" || tokens[6].Pos != 12 {
+		t.Errorf("Unexpected comment tokens: %+v, %+v", tokens[2], tokens[6])
+	}
+
+	if _, err := Tokenize("a $ b"); err == nil {
+		t.Error("Expected error for invalid character")
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["größe"] = 180
+	ctx.Variables["名前"] = "太郎"
+	ctx.Variables["नाम"] = "राम"
+	ctx.Variables["_x1"] = 1
+	ctx.Variables["req"] = map[string]Value{
+		"headers": map[string]Value{"content-type": "application/json", "x.id": "42"},
+	}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"größe > 170", true},
+		{"名前 + \"さん\"", "太郎さん"},
+		{"नाम", "राम"},
+		{"_x1 + 1", int64(2)},
+		{"[1, 2].map(ζ, ζ * 2)[1]", int64(4)},
+		{"req.headers.`content-type`", "application/json"},
+		{"req.headers.`x.id` + \"!\"", "42!"},
+		{"req.`headers`.`content-type`.size()", int64(16)},
+		{"größe >　170", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	compiled, err := NewParser("req.headers.`content-type` == 名前").Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got := compiled.String(); got != "req.headers.`content-type` == 名前" {
+		t.Errorf("Unexpected unparse: %s", got)
+	}
+
+	for _, expr := range []string{"`content-type`", "req.`headers", "req.``", "a € b"} {
+		if _, err := NewParser(expr).Parse(); err == nil {
+			t.Errorf("%s: expected parse error", expr)
+		}
+	}
+}
+
+func TestNullSafeNavigation(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["user"] = map[string]Value{"name": "Alice", "address": nil, "tags": []Value{"a"}}
+	ctx.Variables["customer"] = testCustomer{Name: "Bob"}
+	ctx.Variables["count"] = int64(0)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"user?.name", "Alice"},
+		{"user?.nickname", nil},
+		{"user.address?.city", nil},
+		{"user?.address?.city?.name", nil},
+		{"missing?.name", nil},
+		{"customer.Address?.City", nil},
+		{"user?.name?.upper()", "ALICE"},
+		{"user.address?.upper()", nil},
+		{"user.nickname ?? \"anonymous\"", "anonymous"},
+		{"user.address?.city ?? \"unknown\"", "unknown"},
+		{"user.name ?? \"anonymous\"", "Alice"},
+		{"missing ?? missing2 ?? 1", int64(1)},
+		{"user.tags[5] ?? \"none\"", "none"},
+		{"count ?? 1", int64(0)},
+		{"(user?.address ?? {\"city\": \"Oslo\"}).city", "Oslo"},
+		{"user.name ?? 1 / 0", "Alice"},
+		{"null ?? 1 + 2", int64(3)},
+		{"missing ?? (missing2 ?? 1)", int64(1)},
+		{"missing[0].name ?? 2", int64(2)},
+		{"true ? .5 : 1", 0.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	// Only the links written with ?. are null-safe
+	for _, expr := range []string{"user.address.city", "user?.address.city", "missing.name", "(1 / 0) ?? 1", "user.address?.city.upper()",
+		"size(typo) ?? 0", "user.tags[user.tags[9]] ?? 0", "user[missing] ?? 0", "user.tags.map(t, t.x) ?? 0"} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("Expected %s to fail", expr)
+		}
+	}
+
+	if _, err := NewParser("items?.filter(x, x > 1)").Parse(); err == nil {
+		t.Error("Expected safe navigation on a macro to fail to parse")
+	}
+
+	for _, expr := range []string{"a?.b?.c(1) ?? d", "(a ?? b).c", "a ?? b || c", "a || b ?? c", "a ?? (b ?? c)"} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["perms"] = int64(0b0101)
+	ctx.Variables["mask"] = uint8(0xf0)
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"6 & 3", int64(2)},
+		{"6 | 3", int64(7)},
+		{"xor(6, 3)", int64(5)},
+		{"~0", int64(-1)},
+		{"~0u", uint64(18446744073709551615)},
+		{"1 << 4", int64(16)},
+		{"-16 >> 2", int64(-4)},
+		{"1 << 64", int64(0)},
+		{"1u << 3u", uint64(8)},
+		{"mask >> 4", uint64(0x0f)},
+		{"mask & 0x30u", uint64(0x30)},
+		{"perms & 4 != 0", true},
+		{"perms & 2 == 0", true},
+		{"1 | 2 & 4", int64(1)},
+		{"1 << 2 + 1", int64(8)},
+		{"perms | 1 << 3", int64(13)},
+		{"~perms & 0xf", int64(10)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v (%T), got %v (%T)", test.expected, test.expected, result, result)
+			}
+		})
+	}
+
+	for _, expr := range []string{"1.5 & 1", "1 | 2u", "~1.0", "\"a\" << 1", "1 << -1", "xor(1, 2.0)"} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("Expected %s to fail", expr)
+		}
+	}
+
+	for _, expr := range []string{"a & b | c", "a & (b | c)", "~a << 2", "(a == b) & c", "a && b | c"} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["user"] = map[string]Value{"name": "Alice", "age": int64(30)}
+	ctx.Variables["amount"] = 12.5
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{`f"Hello {user.name}, you owe {format('%.2f', amount)}"`, "Hello Alice, you owe 12.50"},
+		{`f'{user.name} is {user.age} years old'`, "Alice is 30 years old"},
+		{`f"{user.age + 1}{user.age > 18 ? "adult" : "minor"}"`, "31adult"},
+		{`f"{{literal}} {{{user.name}}}"`, "{literal} {Alice}"},
+		{`f"{ {"a": 1}["a"] }"`, "1"},
+		{`f"tab\t{null}"`, "tab\t<nil>"},
+		{`f"outer {f"inner {user.name}"}"`, "outer inner Alice"},
+		{`f"""multi
+{user.name}"""`, "multi\nAlice"},
+		{`f""`, ""},
+		{`f"{[1, 2].map(x, x * 2)}"`, "[2 4]"},
+		{`size(f"{user.name}!")`, int64(6)},
+		{`format("%d-%s", 7, "x")`, "7-x"},
+		{`format("%5.1f%%", 3)`, "  3.0%"},
+		{`format("%x %q %t %v", 255u, "a", true, [1])`, `ff "a" true [1]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+
+	for _, expr := range []string{
+		`format("%d", 3.0)`,
+		`format("%f", "x")`,
+		`format("%s %s", "x")`,
+		`format("%s", "x", "y")`,
+		`format("%p", "x")`,
+		`format("%*d", 3, 4)`,
+		`format("50%")`,
+	} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("Expected %s to fail", expr)
+		}
+	}
+
+	invalid := []struct {
+		expr   string
+		offset int
+	}{
+		{`f"{}"`, 2},
+		{`f"a } b"`, 4},
+		{`f"{user.name"`, 2},
+		{`f"{user.}"`, 8},
+		{`f"oops`, 0},
+		{`f"\q{user}"`, 2},
+	}
+	for _, test := range invalid {
+		_, err := NewParser(test.expr).Parse()
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected %s to fail to parse, got %v", test.expr, err)
+			continue
+		}
+		if parseErr.Offset != test.offset {
+			t.Errorf("%s: expected error at offset %d, got %v", test.expr, test.offset, parseErr)
+		}
+	}
+
+	// A Context built as a struct literal works too
+	bare := &Context{Variables: map[string]Value{"name": "Bo"}, Functions: map[string]Function{}}
+	if result, err := evalExpr(t, bare, `f"hi {name}"`); err != nil || result != "hi Bo" {
+		t.Errorf("Expected hi Bo, got %v, %v", result, err)
+	}
+
+	// Placeholder spans are offsets in the whole expression
+	_, err := evalExpr(t, ctx, `f"x{1 + user.missing}"`)
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) || evalErr.Source != "user.missing" {
+		t.Errorf("Expected error located at user.missing, got %v", err)
+	}
+
+	for _, expr := range []string{
+		`f"a{{b}} {x + 1} \"{y}\""`,
+		`f"{cond ? "y" : "n"}"`,
+		`f"{ {"a": 1} }"`,
+		`f"{ {"a": 1}["a"] }"`,
+		`f"{ {k: v for k, v in m} } and { {"a": 1}.a }"`,
+	} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+
+	compiled, err := NewParser(`f"{a}{b.c}{custom(d)}"`).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := compiled.References(); strings.Join(refs.Variables, ",") != "a,b,d" || strings.Join(refs.Functions, ",") != "custom" {
+		t.Errorf("Unexpected references %+v", refs)
+	}
+}
+
+func TestPipeOperator(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["numbers"] = []Value{int64(2), int64(6), int64(8), int64(10)}
+	ctx.Variables["name"] = "  Alice  "
+	ctx.RegisterFunction("scale", testFunc(func(ctx context.Context, args ...Value) (Value, error) {
+		return args[0].(int64) * args[1].(int64), nil
+	}))
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"numbers |> filter(n, n > 5) |> avg()", 8.0},
+		{"numbers |> map(n, n * 2) |> sum()", int64(52)},
+		{"numbers |> size()", int64(4)},
+		{"numbers |> all(n, n % 2 == 0)", true},
+		{"name |> trim() |> upper()", "ALICE"},
+		{"3 |> scale(4)", int64(12)},
+		{"1 + 2 |> scale(2)", int64(6)},
+		{"numbers |> size() > 3", true},
+		{"let twice = x => x * 2; 21 |> twice()", int64(42)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	// The macro variable is only bound in its own body
+	if _, err := evalExpr(t, ctx, "numbers |> filter(n, n > 5) |> map(m, m - n)"); err == nil {
+		t.Error("Expected unbound macro variable to fail")
+	}
+
+	for _, expr := range []string{"numbers |> 5", "numbers |> size", "numbers |>"} {
+		if _, err := NewParser(expr).Parse(); err == nil {
+			t.Errorf("Expected %s to fail to parse", expr)
+		}
+	}
+
+	for _, expr := range []string{"numbers |> sum", "numbers |> stats.sum()", "numbers |> sum + 1"} {
+		if _, err := NewParser(expr).Parse(); err == nil || !strings.Contains(err.Error(), "pipe target must be a function call such as") {
+			t.Errorf("%s: expected pipe target error, got %v", expr, err)
+		}
+	}
+
+	for _, expr := range []string{"a + b |> f(c) |> g()", "(a |> f()) + 1", "a |> f() == b", "(a == b) |> f()"} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+
+	compiled, err := NewParser("numbers |> filter(n, n > limit) |> custom()").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := compiled.References()
+	if strings.Join(refs.Variables, ",") != "limit,numbers" || strings.Join(refs.Functions, ",") != "custom" {
+		t.Errorf("Unexpected references %+v", refs)
+	}
+}
+
+func TestMatchExpressions(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["tier"] = "silver"
+	ctx.Variables["years"] = int64(7)
+	ctx.Variables["point"] = []Value{int64(0), int64(5)}
+	ctx.Variables["customer"] = map[string]Value{"kind": "vip", "rate": 0.3}
+	ctx.Variables["match"] = int64(3)
+	ctx.Variables["limit"] = int64(10)
+	ctx.Variables["active"] = true
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{`match tier { "gold" => 0.2, "silver" => 0.1, _ => 0.0 }`, 0.1},
+		{`match tier { "gold" => 0.2, "silver" if years > 5 => 0.15, "silver" => 0.1, _ => 0.0 }`, 0.15},
+		{`match years { 0 => "new", n if n > 5 => f"veteran of {n}", n => "member" }`, "veteran of 7"},
+		{`match years { 7.0 => "seven", _ => "other" }`, "seven"},
+		{`match "7" { 7 => "int", _ => "other" }`, "other"},
+		{`match point { [0, y] => y * 2, [x, _] => x, _ => -1 }`, int64(10)},
+		{`match point { [a, b, c] => a, _ => -1 }`, int64(-1)},
+		{`match customer { {"kind": "vip", "rate": r} => r, {"kind": k} => 0.0, _ => -1.0 }`, 0.3},
+		{`match null { null => "none", _ => "some" }`, "none"},
+		{`match (years % 2 == 0) { true => "even", false => "odd", _ => "?" }`, "odd"},
+		{`match years { -1 => "neg", _ => "pos" }.size()`, int64(3)},
+		{`match + 1`, int64(4)},
+		{`match`, int64(3)},
+		{`[match * 2 for match in [1, 2]][1]`, int64(4)},
+		{`2 between match and 10`, false},
+		{`match between 1 and 10`, true},
+		{`match in [1, 3]`, true},
+		{`3 in [match, match + 1]`, true},
+		{`{"k": match}["k"]`, int64(3)},
+		{`let r = 5; match r { x if x > 3 => x, _ => 0 } + 1`, int64(6)},
+		{`match years { n if n > limit => 1, n if [1, 7].exists(x, x == n) => 2, _ => 3 }`, int64(2)},
+		{`match years { v if match v { w if w > 0 => true, _ => false } && active => v, _ => 0 }`, int64(7)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+
+	invalid := []string{
+		`match tier { "gold" => 1 }`,
+		`match tier { _ if years > 1 => 1 }`,
+		`match tier { }`,
+		`match tier { a + 1 => 2, _ => 0 }`,
+		`match tier { "gold" 1, _ => 0 }`,
+	}
+	for _, expr := range invalid {
+		if _, err := NewParser(expr).Parse(); err == nil {
+			t.Errorf("Expected %s to fail to parse", expr)
+		}
+	}
+
+	for _, expr := range []string{`match point { [x, x, y] => x, _ => 0 }`, `match customer { {"a": x, "b": [x]} => x, _ => 0 }`} {
+		if _, err := NewParser(expr).Parse(); err == nil || !strings.Contains(err.Error(), "variable x is bound more than once") {
+			t.Errorf("%s: expected duplicate binding error, got %v", expr, err)
+		}
+	}
+
+	if _, err := evalExpr(t, ctx, `match tier { _ if years => 1, _ => 0 }`); err == nil {
+		t.Error("Expected non-boolean guard to fail")
+	}
+
+	for _, expr := range []string{
+		`match tier { "gold" if years > 5 => 0.2, [a, {"k": b}] => b, _ => a ?? 0 }`,
+		`match x { -1 => null, b"\x00" => 1u, true => 1.5, n => n }`,
+	} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+		if formatted := Format(parsed.AST(), FormatOptions{MaxWidth: 20}); !strings.Contains(formatted, "\n") {
+			t.Errorf("Expected %q to be broken across lines", formatted)
+		} else if reparsed, err := NewParser(formatted).Parse(); err != nil || reparsed.String() != expr {
+			t.Errorf("Formatted %q does not parse back to %q: %v", formatted, expr, err)
+		}
+	}
+
+	compiled, err := NewParser(`match order { {"items": [item, _]} if item.price > limit => item.name, other => other.id }`).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := compiled.References()
+	if strings.Join(refs.Variables, ",") != "limit,order" || len(refs.Fields) != 0 {
+		t.Errorf("Unexpected references %+v", refs)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		expr     string
+		warnings []string
+	}{
+		{`match tier { "gold" => 1, "silver" => 2, _ => 0 }`, nil},
+		{`match tier { "gold" => 1, "gold" => 2, _ => 0 }`, []string{
+			`unreachable match arm: pattern "gold" is already matched`,
+		}},
+		{`match tier { t => 1, "gold" => 2, _ => 0 }`, []string{
+			"unreachable match arm: an earlier arm matches every value",
+		}},
+		{`match a > b { true => 1, false => 2, _ => 0 }`, []string{
+			"unreachable default arm: true and false are both matched",
+		}},
+		{`match a > b { "yes" => 1, 1 => 2, _ => 0 }`, []string{
+			`pattern "yes" can never match a subject of type bool`,
+			"pattern 1 can never match a subject of type bool",
+		}},
+		{`match 3 { 1.0 => 1, [a] => 2, _ => 0 }`, []string{
+			"pattern [a] can never match a subject of type int",
+		}},
+		{`1 + match x { true => 1, false => 2, _ => 0 }`, nil},
+		{`match n { 1 => "a", 1.0 => "b", 1u => "c", 1.5 => "d", _ => "e" }`, []string{
+			"unreachable match arm: pattern 1.0 is already matched",
+			"unreachable match arm: pattern 1u is already matched",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			compiled, err := NewParser(test.expr).Parse()
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			var messages []string
+			for _, warning := range compiled.Check() {
+				messages = append(messages, warning.Message)
+			}
+			if strings.Join(messages, "\n") != strings.Join(test.warnings, "\n") {
+				t.Errorf("Expected warnings %q, got %q", test.warnings, messages)
+			}
+		})
+	}
+}
+
+func TestComprehensions(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["users"] = []Value{
+		map[string]Value{"name": "Alice", "active": true},
+		map[string]Value{"name": "Bob", "active": false},
+		map[string]Value{"name": "Carol", "active": true},
+	}
+	ctx.Variables["prices"] = map[string]Value{"apple": 1.5, "pear": 2.0}
+	ctx.Variables["stock"] = map[string]int{"apple": 3, "pear": 0}
+	ctx.Variables["numbers"] = []int{1, 2, 3, 4}
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"[x.name for x in users if x.active]", "[Alice Carol]"},
+		{"[n * n for n in numbers]", "[1 4 9 16]"},
+		{"[i for i, n in numbers if n % 2 == 0]", "[1 3]"},
+		{"[k for k in prices]", "[apple pear]"},
+		{"[f\"{k}={v}\" for k, v in prices]", "[apple=1.5 pear=2]"},
+		{"{k: v * 2 for k, v in prices}", "map[apple:3 pear:4]"},
+		{"{k: v for k, v in stock if v > 0}", "map[apple:3]"},
+		{"{n % 2: n for n in numbers}", "map[0:4 1:3]"},
+		{"size([u for u in users if !u.active])", "1"},
+		{"[x for x in []]", "[]"},
+		{"[[y for y in numbers if y < x] for x in [2, 3]]", "[[1] [1 2]]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if got := fmt.Sprint(result); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+
+	// Each element is bound in its own scope, so lambdas built by the
+	// comprehension capture their own element
+	adders, err := evalExpr(t, ctx, "let fs = [y => y + x for x in numbers]; fs.map(g, g(10))")
+	if err != nil || fmt.Sprint(adders) != "[11 12 13 14]" {
+		t.Errorf("Expected [11 12 13 14], got %v, %v", adders, err)
+	}
+
+	for _, expr := range []string{"[x for x in 5]", "[x for x in numbers if x]"} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("Expected %s to fail", expr)
+		}
+	}
+
+	for _, expr := range []string{"[x for x in xs for y in ys]", "[x for 1 in xs]", "[x for x, y, z in xs]", "{k for k in m}"} {
+		if _, err := NewParser(expr).Parse(); err == nil {
+			t.Errorf("Expected %s to fail to parse", expr)
+		}
+	}
+
+	for _, expr := range []string{
+		"[u.name for u in users if u.active && u.age > min]",
+		"{k: v * 2 for k, v in prices}",
+		"[x ? 1 : 2 for x in flags]",
+	} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+
+	compiled, err := NewParser("[u.name for u in users if u.age > min]").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := compiled.References()
+	if strings.Join(refs.Variables, ",") != "min,users" || len(refs.Fields) != 0 {
+		t.Errorf("Unexpected references %+v", refs)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	ctx := NewContext()
+	ctx.Variables["a"] = []Value{int64(1), int64(2)}
+	ctx.Variables["b"] = []string{"x"}
+	ctx.Variables["defaults"] = map[string]Value{"id": int64(0), "retries": int64(3), "verbose": false}
+	ctx.Variables["overrides"] = map[string]Value{"verbose": true}
+	ctx.Variables["codes"] = map[Value]Value{int64(200): "ok"}
+	ctx.Variables["id"] = int64(42)
+	ctx.Variables["missing"] = nil
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"[...a, ...b, 3]", "[1 2 x 3]"},
+		{"[0, ...a, ...[]]", "[0 1 2]"},
+		{"[...a.map(x, x * 10)]", "[10 20]"},
+		{"[...missing, 1]", "[1]"},
+		{`{...defaults, ...overrides, "id": id}`, "map[id:42 retries:3 verbose:true]"},
+		{`{"id": 1, ...defaults}`, "map[id:0 retries:3 verbose:false]"},
+		{`{...defaults, "retries": 5, ...overrides}`, "map[id:0 retries:5 verbose:true]"},
+		{`{...missing, "a": 1}`, "map[a:1]"},
+		{`{...codes, 404: "not found"}`, "map[200:ok 404:not found]"},
+		{`{...{"a": 1}, ...{"a": 2}}`, "map[a:2]"},
+		// A spread after an explicit key overrides it, and vice versa
+		{`{"a": 9, ...{"a": 1}}`, "map[a:1]"},
+		{`{...{"a": 1}, "a": 9}`, "map[a:9]"},
+		{"size([...a, ...a])", "4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			result, err := evalExpr(t, ctx, test.expr)
+			if err != nil {
+				t.Fatalf("Evaluation failed: %v", err)
+			}
+			if got := fmt.Sprint(result); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+
+	for _, expr := range []string{"[...defaults]", "[...id]", `{...a}`, `{"a": 1, "a": 2}`, `{"a": 1, ...id}`} {
+		if _, err := evalExpr(t, ctx, expr); err == nil {
+			t.Errorf("Expected %s to fail", expr)
+		}
+	}
+
+	invalid := []struct {
+		expr    string
+		message string
+	}{
+		{"[...5]", "cannot spread int value into a list"},
+		{`[..."abc"]`, "cannot spread string value into a list"},
+		{"[...{}]", "cannot spread map value into a list"},
+		{"{...[1]}", "cannot spread list value into a map"},
+		{"{...x > 1}", "cannot spread bool value into a map"},
+		{"[...]", "expected expression"},
+	}
+	for _, test := range invalid {
+		_, err := NewParser(test.expr).Parse()
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected error containing %q, got %v", test.expr, test.message, err)
+		}
+	}
+
+	for _, expr := range []string{`[...a, ...b ?? [], 3]`, `{...defaults, ...overrides, "id": id}`} {
+		parsed, err := NewParser(expr).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if got := parsed.String(); got != expr {
+			t.Errorf("Unparse(%q) = %q", expr, got)
+		}
+	}
+}